@@ -0,0 +1,362 @@
+package sdbot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgType is the type of an argument of a Plugin.
+type ArgType int
+
+// The types of arguments. ArgUser takes the name of any user, and ArgRoom the
+// name of a room the bot is in.
+const (
+	ArgString ArgType = iota
+	ArgInt
+	ArgDuration
+	ArgUser
+	ArgRoom
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case ArgInt:
+		return "int"
+	case ArgDuration:
+		return "duration"
+	case ArgUser:
+		return "user"
+	case ArgRoom:
+		return "room"
+	default:
+		return "string"
+	}
+}
+
+// Arg describes an argument of a Plugin. An Optional argument that is not
+// given takes its Default value, if it has one. A Variadic argument takes all
+// the arguments that are left, and must be the last one.
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+	Default  string
+	Variadic bool
+}
+
+// ErrInvalidArgSpec is returned when the Args of a Plugin cannot be parsed,
+// such as when a required argument follows an optional one.
+var ErrInvalidArgSpec = errors.New("sdbot: invalid argument spec")
+
+// ErrInvalidArgs is wrapped by the errors of messages whose arguments do not
+// fit the Args of a Plugin.
+var ErrInvalidArgs = errors.New("sdbot: invalid arguments")
+
+// ArgValues holds the arguments of a message parsed with the Args of a
+// Plugin, by name. The value of an argument that was not given and has no
+// default is the zero value of its type.
+type ArgValues map[string]interface{}
+
+// String returns a string argument.
+func (v ArgValues) String(name string) string {
+	s, _ := v[name].(string)
+	return s
+}
+
+// Int returns an int argument.
+func (v ArgValues) Int(name string) int {
+	n, _ := v[name].(int)
+	return n
+}
+
+// Duration returns a duration argument.
+func (v ArgValues) Duration(name string) time.Duration {
+	d, _ := v[name].(time.Duration)
+	return d
+}
+
+// User returns a user argument.
+func (v ArgValues) User(name string) *User {
+	u, _ := v[name].(*User)
+	return u
+}
+
+// Room returns a room argument.
+func (v ArgValues) Room(name string) *Room {
+	r, _ := v[name].(*Room)
+	return r
+}
+
+// List returns the values of a variadic argument.
+func (v ArgValues) List(name string) []interface{} {
+	l, _ := v[name].([]interface{})
+	return l
+}
+
+// Strings returns the values of a variadic string argument.
+func (v ArgValues) Strings(name string) []string {
+	var strs []string
+	for _, e := range v.List(name) {
+		if s, ok := e.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// Has returns true if the argument was given or has a default.
+func (v ArgValues) Has(name string) bool {
+	_, ok := v[name]
+	return ok
+}
+
+// Returns an error if the Args of the plugin cannot be parsed.
+func (p *Plugin) validateArgs() error {
+	var optional bool
+	seen := make(map[string]bool)
+	for i, arg := range p.Args {
+		switch {
+		case arg.Name == "" || seen[arg.Name]:
+			return fmt.Errorf("%w: missing or repeated argument name %q", ErrInvalidArgSpec, arg.Name)
+		case arg.Variadic && i != len(p.Args)-1:
+			return fmt.Errorf("%w: variadic argument %s is not the last", ErrInvalidArgSpec, arg.Name)
+		case optional && !arg.Optional && !arg.Variadic:
+			return fmt.Errorf("%w: required argument %s follows an optional one", ErrInvalidArgSpec, arg.Name)
+		}
+		seen[arg.Name] = true
+		optional = optional || arg.Optional
+	}
+	return nil
+}
+
+// Usage returns the usage line of the plugin's Args, such as
+// ".ban <user:user>, <hours:int>, [reason=spam]". Optional arguments are in
+// brackets with their default, and variadic ones end in "...".
+func (p *Plugin) Usage() string {
+	prefix := p.Bot.usagePrefix()
+
+	args := make([]string, len(p.Args))
+	for i, arg := range p.Args {
+		name := arg.Name
+		if arg.Type != ArgString {
+			name += ":" + arg.Type.String()
+		}
+		if arg.Variadic {
+			name += "..."
+		}
+		switch {
+		case arg.Optional && arg.Default != "":
+			args[i] = "[" + name + "=" + arg.Default + "]"
+		case arg.Optional:
+			args[i] = "[" + name + "]"
+		default:
+			args[i] = "<" + name + ">"
+		}
+	}
+	if len(args) == 0 {
+		return prefix + p.Command
+	}
+	return prefix + p.Command + " " + strings.Join(args, ", ")
+}
+
+// Returns the prefix commands are shown with in usage lines, which is the
+// first of the PluginPrefixes of the Config.
+func (b *Bot) usagePrefix() string {
+	if b == nil || len(b.Config.PluginPrefixes) == 0 {
+		return ""
+	}
+	return b.Config.PluginPrefixes[0]
+}
+
+// The arguments of a message parsed for a plugin by the router, which the
+// plugin's workers pick up from the message.
+type parsedArgs struct {
+	values ArgValues
+	given  []string
+}
+
+// Parses the arguments of a message with the Args of the plugin. They are
+// separated by commas, and a comma can be put in an argument by quoting it. A
+// last string argument that is not variadic takes the rest of the message,
+// commas and all. Returns the values, the arguments as they were given, and
+// an error wrapping ErrInvalidArgs if they do not fit.
+func (p *Plugin) parseArgs(m *Message) (ArgValues, []string, error) {
+	values := make(ArgValues)
+	if len(p.Args) == 0 {
+		return values, nil, nil
+	}
+
+	var rest string
+	if submatches := p.Prefix.FindStringSubmatch(m.Message); len(submatches) > 0 {
+		rest = submatches[len(submatches)-1]
+	}
+
+	limit := -1
+	if last := p.Args[len(p.Args)-1]; last.Type == ArgString && !last.Variadic {
+		limit = len(p.Args)
+	}
+	given := splitArgs(rest, limit)
+
+	for i, arg := range p.Args {
+		if arg.Variadic {
+			var list []interface{}
+			for ; i < len(given); i++ {
+				v, err := p.convertArg(arg, given[i])
+				if err != nil {
+					return nil, given, err
+				}
+				list = append(list, v)
+			}
+			if len(list) == 0 && !arg.Optional {
+				return nil, given, fmt.Errorf("%w: %s is missing", ErrInvalidArgs, arg.Name)
+			}
+			if len(list) > 0 {
+				values[arg.Name] = list
+			}
+			return values, given, nil
+		}
+
+		s := ""
+		if i < len(given) {
+			s = given[i]
+		}
+		if s == "" {
+			if !arg.Optional {
+				return nil, given, fmt.Errorf("%w: %s is missing", ErrInvalidArgs, arg.Name)
+			}
+			if arg.Default == "" {
+				continue
+			}
+			s = arg.Default
+		}
+		v, err := p.convertArg(arg, s)
+		if err != nil {
+			return nil, given, err
+		}
+		values[arg.Name] = v
+	}
+
+	if len(given) > len(p.Args) {
+		return nil, given, fmt.Errorf("%w: too many arguments", ErrInvalidArgs)
+	}
+	return values, given, nil
+}
+
+// Converts an argument to the value of its type.
+func (p *Plugin) convertArg(arg Arg, s string) (interface{}, error) {
+	switch arg.Type {
+	case ArgInt:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be a whole number", ErrInvalidArgs, arg.Name)
+		}
+		return n, nil
+	case ArgDuration:
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("%w: %s must be a duration like 90s or 1h30m", ErrInvalidArgs, arg.Name)
+		}
+		return d, nil
+	case ArgUser:
+		if id := Sanitize(s); id == "" || len(id) > maxUsernameLength {
+			return nil, fmt.Errorf("%w: %s must be a username", ErrInvalidArgs, arg.Name)
+		}
+		return p.Bot.lookupUser(s), nil
+	case ArgRoom:
+		r := p.Bot.lookupRoom(s)
+		if r == nil {
+			return nil, fmt.Errorf("%w: %s must be a room the bot is in", ErrInvalidArgs, arg.Name)
+		}
+		return r, nil
+	default:
+		return s, nil
+	}
+}
+
+// Returns the user of that name in the UserList, or a new User that is not
+// added to it, so that arguments cannot rename known users or fill the
+// UserList with made up names.
+func (b *Bot) lookupUser(name string) *User {
+	var lookup = func() interface{} {
+		return b.UserList[Sanitize(name)]
+	}
+	if u, _ := b.Synchronize("room", &lookup).(*User); u != nil {
+		return u
+	}
+	return NewUser(name)
+}
+
+// Returns the room of that name in the RoomList, or nil if the bot does not
+// know it.
+func (b *Bot) lookupRoom(name string) *Room {
+	var lookup = func() interface{} {
+		return b.RoomList[SanitizeRoomid(name)]
+	}
+	r, _ := b.Synchronize("room", &lookup).(*Room)
+	return r
+}
+
+// The longest a username can be on Showdown, once sanitized.
+const maxUsernameLength = 18
+
+// Splits arguments at the commas that are not between double quotes, into at
+// most limit arguments if limit is positive. The last of those keeps the rest
+// of the string. Arguments are trimmed, and unquoted if they are quoted. Only
+// a double quote that starts an argument quotes it, so quotes elsewhere are
+// kept as they are. A quote can be put in a quoted argument as \".
+func splitArgs(s string, limit int) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+
+	var args []string
+	var arg strings.Builder
+	var quoted bool
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case limit > 0 && len(args) == limit-1:
+			args = append(args, unquote(strings.TrimSpace(s[i:])))
+			return args
+		case c == '\\' && quoted && i+1 < len(s) && s[i+1] == '"':
+			arg.WriteByte('"')
+			i++
+		case c == '"' && quoted:
+			quoted = false
+		case c == '"' && strings.TrimSpace(arg.String()) == "":
+			quoted = true
+		case c == ',' && !quoted:
+			args = append(args, strings.TrimSpace(arg.String()))
+			arg.Reset()
+			for i+1 < len(s) && s[i+1] == ' ' {
+				i++
+			}
+		default:
+			arg.WriteByte(c)
+		}
+	}
+	return append(args, strings.TrimSpace(arg.String()))
+}
+
+// Removes the quotes around an argument that is quoted as a whole.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.Replace(s[1:len(s)-1], `\"`, `"`, -1)
+	}
+	return s
+}
+
+// Replies to a message whose arguments do not fit the Args of the plugin with
+// what was wrong and the usage of the plugin.
+func (p *Plugin) usage(m *Message, err error) {
+	Debugf("[on plugin] Plugin `%s` refused the arguments of %q: %v", p.Name, m.Message, err)
+	if m.Target == nil {
+		return
+	}
+	reason := strings.TrimPrefix(err.Error(), ErrInvalidArgs.Error()+": ")
+	m.Reply(fmt.Sprintf("%s. Usage: %s", reason, p.Usage()))
+}
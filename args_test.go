@@ -0,0 +1,175 @@
+package sdbot
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSplitArgs tests that arguments are split at commas outside of quotes,
+// that only a quote starting an argument quotes it, and that the last argument
+// keeps the rest when there is a limit.
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		s        string
+		limit    int
+		expected []string
+	}{
+		{"", -1, nil},
+		{"a, b,c", -1, []string{"a", "b", "c"}},
+		{`"a, b", c`, -1, []string{"a, b", "c"}},
+		{`"say \"hi\"", c`, -1, []string{`say "hi"`, "c"}},
+		{"a, b, c, d", 2, []string{"a", "b, c, d"}},
+		{`a, "b, c"`, 2, []string{"a", "b, c"}},
+		{"a,, c", -1, []string{"a", "", "c"}},
+		{`it's 5" tall, x`, -1, []string{`it's 5" tall`, "x"}},
+		{`a "b, c" d`, -1, []string{`a "b`, `c" d`}},
+	}
+	for _, test := range tests {
+		if args := splitArgs(test.s, test.limit); !reflect.DeepEqual(args, test.expected) {
+			t.Errorf(`splitArgs(%q, %d) (%q) should == %q`, test.s, test.limit, args, test.expected)
+		}
+	}
+}
+
+// TestParseArgs tests that arguments are converted to their types, that
+// optional arguments take their defaults, and that variadic arguments take
+// the rest.
+func TestParseArgs(t *testing.T) {
+	b := initBot()
+	b.RoomList["lobby"] = &Room{Name: "lobby"}
+	p := NewPlugin("ban")
+	p.Args = []Arg{
+		{Name: "user", Type: ArgUser},
+		{Name: "for", Type: ArgDuration},
+		{Name: "room", Type: ArgRoom, Optional: true, Default: "lobby"},
+		{Name: "strikes", Type: ArgInt, Variadic: true, Optional: true},
+	}
+	if err := b.RegisterPlugin(p, "ban"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	values, _, err := p.parseArgs(&Message{Message: ".ban Tympy, 1h30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := values.User("user"); u == nil || u.Name != "Tympy" {
+		t.Errorf(`values.User("user") (%v) should be Tympy`, u)
+	}
+	if d := values.Duration("for"); d != 90*time.Minute {
+		t.Errorf(`values.Duration("for") (%v) should == 1h30m`, d)
+	}
+	if r := values.Room("room"); r == nil || r.Name != "lobby" {
+		t.Errorf(`values.Room("room") (%v) should be lobby`, r)
+	}
+	if values.Has("strikes") {
+		t.Error(`values.Has("strikes") should == false`)
+	}
+
+	values, _, err = p.parseArgs(&Message{Message: ".ban Tympy, 1h, Lobby, 1, 2, 3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strikes := values.List("strikes"); !reflect.DeepEqual(strikes, []interface{}{1, 2, 3}) {
+		t.Errorf(`values.List("strikes") (%v) should == [1 2 3]`, strikes)
+	}
+
+	bad := []string{".ban", ".ban Tympy", ".ban Tympy, soon", ".ban Tympy, 1h, nowhere", ".ban Tympy, 1h, lobby, x"}
+	for _, msg := range bad {
+		if _, _, err := p.parseArgs(&Message{Message: msg}); !errors.Is(err, ErrInvalidArgs) {
+			t.Errorf(`p.parseArgs(%q) (%v) should return ErrInvalidArgs`, msg, err)
+		}
+	}
+
+	if usage := p.Usage(); usage != ".ban <user:user>, <for:duration>, [room:room=lobby], [strikes:int...]" {
+		t.Errorf(`p.Usage() (%s) is wrong`, usage)
+	}
+}
+
+// TestArgsUsageReply tests that a message with the wrong arguments is replied
+// to with the usage instead of reaching the plugin, and that invalid specs are
+// refused at registration.
+func TestArgsUsageReply(t *testing.T) {
+	b := initBot()
+	p := NewPlugin("quote")
+	p.Args = []Arg{{Name: "author", Type: ArgUser}, {Name: "text"}}
+	if err := b.RegisterPlugin(p, "quote"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	values, _, err := p.parseArgs(&Message{Message: ".quote Tympy, hello, world"})
+	if err != nil || values.String("text") != "hello, world" {
+		t.Errorf(`values.String("text") (%q, %v) should == "hello, world"`, values.String("text"), err)
+	}
+
+	st := &stubTarget{}
+	onChat(&Message{Bot: b, Kind: KindChat, User: NewUser("Tympy"), Target: st, Message: ".quote Tympy"})
+	if len(st.replies) != 1 || st.replies[0] != "text is missing. Usage: .quote <author:user>, <text>" {
+		t.Errorf(`st.replies (%q) should hold the usage`, st.replies)
+	}
+
+	q := NewPlugin("bad")
+	q.Args = []Arg{{Name: "a", Optional: true}, {Name: "b"}}
+	if err := b.RegisterPlugin(q, "bad"); !errors.Is(err, ErrInvalidArgSpec) {
+		t.Errorf(`err (%v) should be ErrInvalidArgSpec`, err)
+	}
+}
+
+// TestArgUserLookup tests that user arguments neither rename the users the
+// bot knows nor add made up users to the UserList.
+func TestArgUserLookup(t *testing.T) {
+	b := initBot()
+	known := FindUserEnsured("Tympy", b)
+	p := NewPlugin("whois")
+	p.Args = []Arg{{Name: "user", Type: ArgUser}}
+	if err := b.RegisterPlugin(p, "whois"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	values, _, err := p.parseArgs(&Message{Message: ".whois TYMPY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.User("user") != known || known.Name != "Tympy" {
+		t.Errorf(`values.User("user") (%v) should be the known user, still named Tympy`, values.User("user"))
+	}
+
+	n := len(b.UserList)
+	if _, _, err := p.parseArgs(&Message{Message: ".whois Nobody"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.UserList) != n {
+		t.Errorf(`len(b.UserList) (%d) should still == %d`, len(b.UserList), n)
+	}
+}
+
+// TestArgValuesRouted tests that the arguments parsed by the router reach the
+// handler of the plugin.
+func TestArgValuesRouted(t *testing.T) {
+	b := initBot()
+	values := make(chan ArgValues, 1)
+	p := NewPlugin("add")
+	p.Args = []Arg{{Name: "a", Type: ArgInt}, {Name: "b", Type: ArgInt}}
+	p.SetHandler(func(c *Context) error {
+		values <- c.Values
+		return nil
+	})
+	if err := b.RegisterPlugin(p, "add"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	onChat(&Message{Bot: b, Kind: KindChat, User: NewUser("Tympy"), Target: &stubTarget{}, Message: ".add 1, 2"})
+	select {
+	case v := <-values:
+		if v.Int("a") != 1 || v.Int("b") != 2 {
+			t.Errorf(`v (%v) should hold a=1 and b=2`, v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`the handler should have been called`)
+	}
+}
@@ -0,0 +1,145 @@
+package sdbot
+
+import (
+	"errors"
+)
+
+// BotOwner is the auth level of the users listed in the Owners of the Config.
+// A plugin that requires it can only be used by them. Owners pass every other
+// auth requirement as well.
+const BotOwner = "owner"
+
+// ErrUnknownAuth is returned when a Plugin requires an auth level that does
+// not exist.
+var ErrUnknownAuth = errors.New("sdbot: unknown auth level")
+
+// RequireAuth makes the plugin only handle the messages of users with at
+// least the given auth level in the room the message was sent in, such as
+// Moderator, or of the owners of the bot with BotOwner. In private messages
+// the rank in the AuthRoom of the plugin or of the Config is checked, or the
+// global rank of the user if neither is set.
+func (p *Plugin) RequireAuth(level string) {
+	p.Auth = level
+	p.GlobalAuth = false
+}
+
+// RequireGlobalAuth makes the plugin only handle the messages of users with at
+// least the given global auth level. The bot learns the global rank of a user
+// from their private messages, so users who have not sent one are treated as
+// unvoiced.
+func (p *Plugin) RequireGlobalAuth(level string) {
+	p.Auth = level
+	p.GlobalAuth = true
+}
+
+func validAuth(level string) bool {
+	if level == BotOwner {
+		return true
+	}
+	_, ok := authLevels[level]
+	return ok
+}
+
+// Returns true if the auth level is at least the required one. Levels that
+// are not ranks, such as BotOwner, are never reached.
+func hasLevel(auth string, level string) bool {
+	required, ok := authLevels[level]
+	return ok && authLevels[auth] >= required
+}
+
+// Returns the global rank of the user, under the lock it is set with.
+func (b *Bot) globalAuth(u *User) string {
+	var getAuth = func() interface{} {
+		return u.GlobalAuth
+	}
+	return b.Synchronize("room", &getAuth).(string)
+}
+
+// IsOwner returns true if the user is one of the Owners of the Config, or has
+// the BotOwner role in the Policy.
+func (b *Bot) IsOwner(u *User) bool {
+	if u == nil {
+		return false
+	}
+	return includes(b.Config.Owners, Sanitize(u.Name)) || b.Policy.HasRole(u.Name, BotOwner)
+}
+
+// Whether the sender of a message may use a plugin. Denied users are told so
+// with the denial reply, and ignored users, who are blacklisted, are not
+// replied to at all, so that they cannot make the bot spam.
+type access int
+
+const (
+	accessAllowed access = iota
+	accessDenied
+	accessIgnored
+)
+
+// Returns whether the sender of the message may use the plugin: they must
+// not be blacklisted, must be on the whitelist of the plugin if it has one,
+// and must meet its auth requirement. Messages without a sender, such as
+// HTML, are only refused by an auth requirement.
+func (p *Plugin) authorized(m *Message) access {
+	if m.User == nil {
+		if p.Auth == "" {
+			return accessAllowed
+		}
+		return accessIgnored
+	}
+	if p.Bot.IsOwner(m.User) {
+		return accessAllowed
+	}
+	var room string
+	if m.Room != nil && !m.Private() {
+		room = m.Room.Name
+	}
+	if a := p.Bot.Policy.check(Sanitize(m.User.Name), p.Name, room); a != accessAllowed {
+		return a
+	}
+	if p.Auth == "" || p.meetsAuth(m) {
+		return accessAllowed
+	}
+	return accessDenied
+}
+
+// Returns true if the sender of the message has the auth level the plugin
+// requires.
+func (p *Plugin) meetsAuth(m *Message) bool {
+	switch {
+	case p.Auth == BotOwner:
+		return false
+	case p.GlobalAuth && m.Private():
+		return hasLevel(m.Auth, p.Auth)
+	case p.GlobalAuth:
+		return hasLevel(p.Bot.globalAuth(m.User), p.Auth)
+	case m.Private():
+		room := p.AuthRoom
+		if room == "" {
+			room = p.Bot.Config.AuthRoom
+		}
+		if room == "" {
+			return hasLevel(m.Auth, p.Auth)
+		}
+		return m.User.HasAuth(room, p.Auth)
+	default:
+		return hasLevel(m.Auth, p.Auth)
+	}
+}
+
+// Replies to a message the plugin denied with the DenialReply of the plugin,
+// or the AuthDenialReply of the Config. Says nothing if neither is set, or if
+// the message has no sender, such as HTML.
+func (p *Plugin) deny(m *Message) {
+	if m.User == nil {
+		return
+	}
+	Debugf("[on plugin] Plugin `%s` refused a message of `%s`", p.Name, m.User.Name)
+
+	reply := p.DenialReply
+	if reply == "" {
+		reply = p.Bot.Config.AuthDenialReply
+	}
+	if reply != "" && m.Target != nil {
+		m.Reply(reply)
+	}
+}
@@ -0,0 +1,133 @@
+package sdbot
+
+import (
+	"errors"
+	"testing"
+)
+
+type stubTarget struct {
+	replies []string
+}
+
+func (st *stubTarget) Reply(m *Message, res string)    { st.replies = append(st.replies, res) }
+func (st *stubTarget) RawReply(m *Message, res string) { st.replies = append(st.replies, res) }
+func (st *stubTarget) Command(m *Message, name string, args ...string) error {
+	return nil
+}
+
+// TestHasAuthRoomCase tests that HasAuth finds the auth of a user in a room
+// whose name has capitals.
+func TestHasAuthRoomCase(t *testing.T) {
+	u := NewUser("Tympy")
+	u.AddAuth("Test Room", Moderator)
+	if !u.HasAuth("Test Room", Driver) {
+		t.Error(`u.HasAuth("Test Room", Driver) should == true`)
+	}
+	if u.HasAuth("testroom", RoomOwner) {
+		t.Error(`u.HasAuth("testroom", RoomOwner) should == false`)
+	}
+}
+
+// TestHasAuthOwner tests that the BotOwner level, which is not a rank, is
+// never met by HasAuth and HasGlobalAuth.
+func TestHasAuthOwner(t *testing.T) {
+	u := NewUser("Tympy")
+	u.AddAuth("testroom", Administrator)
+	u.GlobalAuth = Administrator
+	if u.HasAuth("testroom", BotOwner) || u.HasGlobalAuth(BotOwner) {
+		t.Error(`u.HasAuth("testroom", BotOwner) and u.HasGlobalAuth(BotOwner) should == false`)
+	}
+	if u.HasAuth("otherroom", "x") {
+		t.Error(`u.HasAuth("otherroom", "x") should == false`)
+	}
+}
+
+// TestPluginAuthorized tests the auth requirements of a plugin in rooms, in
+// private messages and for the owners of the bot.
+func TestPluginAuthorized(t *testing.T) {
+	b := initBot()
+	b.Config.Owners = []string{"owner"}
+	p := NewPlugin("mod")
+	p.RequireAuth(Moderator)
+	if err := b.RegisterPlugin(p, "mod"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	room := &Room{Name: "testroom"}
+	mod := NewUser("Mod")
+	mod.AddAuth("testroom", Moderator)
+	voice := NewUser("Voice")
+	owner := NewUser("Owner")
+
+	tests := []struct {
+		m        *Message
+		expected bool
+	}{
+		{&Message{User: mod, Auth: Moderator, Target: room}, true},
+		{&Message{User: voice, Auth: Voiced, Target: room}, false},
+		{&Message{User: owner, Auth: Unvoiced, Target: room}, true},
+		{&Message{User: mod, Auth: Unvoiced, Target: mod}, false},
+		{&Message{User: voice, Auth: Moderator, Target: voice}, true},
+	}
+	for i, test := range tests {
+		if ok := p.authorized(test.m) == accessAllowed; ok != test.expected {
+			t.Errorf(`p.authorized(tests[%d].m) (%v) should == %v`, i, ok, test.expected)
+		}
+	}
+
+	b.Config.AuthRoom = "TestRoom"
+	if p.authorized(&Message{User: mod, Auth: Unvoiced, Target: mod}) != accessAllowed {
+		t.Error(`a moderator of the AuthRoom should be authorized in private messages`)
+	}
+
+	p.RequireAuth(BotOwner)
+	if p.authorized(&Message{User: mod, Auth: Administrator, Target: room}) != accessDenied {
+		t.Error(`only owners should be authorized by BotOwner`)
+	}
+}
+
+// TestPluginDeny tests that refused users are replied to with the denial
+// reply, and that unknown auth levels are refused at registration.
+func TestPluginDeny(t *testing.T) {
+	b := initBot()
+	p := NewPlugin("deny")
+	p.RequireAuth(Driver)
+	p.DenialReply = "nope"
+	if err := b.RegisterPlugin(p, "deny"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	st := &stubTarget{}
+	onChat(&Message{Bot: b, Kind: KindChat, User: NewUser("Voice"), Auth: Voiced, Target: st, Message: ".deny"})
+	if len(st.replies) != 1 || st.replies[0] != "nope" {
+		t.Errorf(`st.replies (%q) should == ["nope"]`, st.replies)
+	}
+
+	q := NewPlugin("bad")
+	q.RequireAuth("x")
+	if err := b.RegisterPlugin(q, "bad"); !errors.Is(err, ErrUnknownAuth) {
+		t.Errorf(`err (%v) should be ErrUnknownAuth`, err)
+	}
+}
+
+// TestPluginDenyHTML tests that HTML messages, which have no sender, are
+// refused by an auth requirement without a reply.
+func TestPluginDenyHTML(t *testing.T) {
+	b := initBot()
+	p := NewPlugin("poll")
+	p.Kinds = []Kind{KindHTML}
+	p.RequireAuth(Driver)
+	p.DenialReply = "nope"
+	if err := b.RegisterPlugin(p, "poll"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	st := &stubTarget{}
+	onHTML(&Message{Bot: b, Kind: KindHTML, Target: st, Message: ".poll"})
+	if len(st.replies) != 0 {
+		t.Errorf(`st.replies (%q) should be empty`, st.replies)
+	}
+}
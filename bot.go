@@ -1,14 +1,16 @@
 package sdbot
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"io/ioutil"
-	"net/http"
-	"net/url"
+	"fmt"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/mikopits/sdbot/protocol"
 )
 
 // Bot represents the entrypoint to all the necessary behaviour of the bot.
@@ -18,6 +20,10 @@ import (
 type Bot struct {
 	Config                *Config
 	Connection            *Connection
+	LoginClient           LoginClient
+	Paster                Paster
+	Loggers               *LoggerList
+	Policy                *Policy
 	UserList              map[string]*User
 	RoomList              map[string]*Room
 	Rooms                 []string
@@ -32,14 +38,36 @@ type Bot struct {
 	ppcMutex              sync.Mutex
 	semMutex              sync.Mutex
 	semaphores            map[string]*sync.Mutex
+	hookMutex             sync.Mutex
+	handlers              map[string]func(*Message)
+	subscriptions         map[string][]*Subscription
+	router                *router
+	timedPluginsOnce      sync.Once
+	errorHooks            []func(error)
+	disconnectHooks       []func(error)
+	reconnectHooks        []func(int)
 }
 
 // NewBot creates a new instance of the Bot struct. In doing so it creates a
-// new Connection as well as adds a PrettyLogger to the Loggers that logs to
-// os.Stderr. It takes a path to the configuration TOML file.
-func NewBot(path string) *Bot {
+// new Connection, an HTTPLoginClient for the Config's LoginServer, as well as
+// a LoggerList containing a PrettyLogger that logs to os.Stderr, along with
+// the loggers added with the deprecated AddLogger. It takes a path to the
+// configuration TOML file. Every Bot holds its own state, so several bots can
+// run in the same process. Returns an error if the configuration could not be
+// read.
+func NewBot(path string) (*Bot, error) {
+	config, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := newPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
 	b := &Bot{
-		Config:                readConfig(path),
+		Config:                config,
+		Policy:                policy,
 		UserList:              make(map[string]*User),
 		RoomList:              make(map[string]*Room),
 		Plugins:               []*Plugin{},
@@ -48,61 +76,40 @@ func NewBot(path string) *Bot {
 		PluginPrivateChannels: make(map[string]*chan *Message, 64),
 		semaphores:            make(map[string]*sync.Mutex),
 		RecentBattles:         make(chan *RecentBattles, 1),
+		Loggers:               defaultLoggers.copy(),
+		handlers:              newHandlers(),
+		subscriptions:         make(map[string][]*Subscription),
+		router:                newRouter(config),
 	}
 	b.Nick = b.Config.Nick
+	b.LoginClient = NewHTTPLoginClient(b.Config.LoginServer)
 	b.Connection = NewConnection(b)
-	loggers = NewLoggerList(&PrettyLogger{AnyLogger{Output: os.Stderr}})
-	return b
+	return b, nil
 }
 
-// login connects to the Pokemon Showdown server.
-func (b *Bot) login(msg *Message) {
-	var res *http.Response
-	var err error
-
-	loginURL := "https://play.pokemonshowdown.com/action.php"
-
-	if b.Config.Password == "" {
-		res, err = http.Get(strings.Join([]string{
-			loginURL,
-			"?act=getassertion&userid=", Sanitize(b.Config.Nick),
-			"&challengekeyid=", msg.Params[0],
-			"&challenge=", msg.Params[1],
-		}, ""))
-	} else {
-		res, err = http.PostForm(loginURL, url.Values{
-			"act":            {"login"},
-			"name":           {b.Config.Nick},
-			"pass":           {b.Config.Password},
-			"challengekeyid": {msg.Params[0]},
-			"challenge":      {msg.Params[1]},
-		})
-	}
-	CheckErr(err)
-
-	defer res.Body.Close()
-
-	body, err := ioutil.ReadAll(res.Body)
-	CheckErr(err)
-
-	if b.Config.Password == "" {
-		b.Connection.QueueMessage(strings.Join([]string{"|/trn ", b.Config.Nick, ",0,", string(body)}, ""))
-	} else {
-		type LoginDetails struct {
-			Assertion string
-		}
-		data := LoginDetails{}
-		err = json.Unmarshal(body[1:], &data)
-		CheckErr(err)
+// login connects to the Pokemon Showdown server. The assertion is obtained
+// from the bot's LoginClient.
+func (b *Bot) login(msg *Message) error {
+	challstr, ok := msg.Parsed.(*protocol.Challstr)
+	if !ok {
+		return &LoginError{Err: ErrLoginFailed, Message: "malformed challstr"}
+	}
 
-		b.Connection.QueueMessage(strings.Join([]string{"|/trn ", b.Config.Nick, ",0,", data.Assertion}, ""))
+	assertion, err := b.LoginClient.Assertion(b.Config.Nick, b.Config.Password, challstr.KeyID, challstr.Challenge)
+	if err != nil {
+		return err
 	}
+
+	b.Connection.QueueMessage(strings.Join([]string{"|/trn ", b.Config.Nick, ",0,", assertion}, ""))
+	return nil
 }
 
 // JoinRoom makes the bot join a room.
 func (b *Bot) JoinRoom(room *Room) {
 	var joinRoom = func() interface{} {
-		b.Rooms = append(b.Rooms, room.Name)
+		if !includes(b.Rooms, room.Name) {
+			b.Rooms = append(b.Rooms, room.Name)
+		}
 		if b.RoomList[room.Name] != nil {
 			b.RoomList[room.Name] = room
 		}
@@ -144,20 +151,40 @@ var ErrPluginAlreadyRegistered = errors.New("sdbot: plugin was already registere
 func (b *Bot) RegisterPlugin(p *Plugin, name string) error {
 	for _, plugin := range b.Plugins {
 		if plugin == p {
-			Error(ErrPluginAlreadyRegistered)
 			return ErrPluginAlreadyRegistered
 		}
 	}
 
 	if b.PluginChatChannels[name] != nil {
-		Error(ErrPluginNameAlreadyRegistered)
 		return ErrPluginNameAlreadyRegistered
 	}
 
+	p.Overflow = strings.ToLower(p.Overflow)
+	if p.Overflow != "" && !validOverflow(p.Overflow) {
+		return ErrUnknownOverflow
+	}
+
+	if p.Auth != "" && !validAuth(p.Auth) {
+		return ErrUnknownAuth
+	}
+	if p.CooldownExempt != "" && !validAuth(p.CooldownExempt) {
+		return ErrUnknownAuth
+	}
+
+	if err := p.validateArgs(); err != nil {
+		return err
+	}
+
+	p.CooldownScope = strings.ToLower(p.CooldownScope)
+	if p.CooldownScope != "" && !validCooldownScope(p.CooldownScope) {
+		return ErrUnknownCooldownScope
+	}
+
 	p.Bot = b
 	p.Name = name
 
 	// Load prefix and suffix from the config if none were provided.
+	configPrefix := p.Prefix == nil || p.Prefix == b.Config.PluginPrefix
 	if p.Prefix == nil {
 		p.Prefix = b.Config.PluginPrefix
 	}
@@ -165,11 +192,18 @@ func (b *Bot) RegisterPlugin(p *Plugin, name string) error {
 		p.Suffix = b.Config.PluginSuffix
 	}
 
-	p.formatPrefixAndSuffix()
+	err := p.formatPrefixAndSuffix()
+	if err != nil {
+		return err
+	}
 	Debugf("[on bot] Registering plugin `%s` listening on prefix `%v` and suffix `%v`", name, p.Prefix, p.Suffix)
 
-	chatChannel := make(chan *Message, 64)
-	privateChannel := make(chan *Message, 64)
+	queueLength := p.QueueLength
+	if queueLength <= 0 {
+		queueLength = b.Config.PluginQueueLength
+	}
+	chatChannel := make(chan *Message, queueLength)
+	privateChannel := make(chan *Message, queueLength)
 	b.pccMutex.Lock()
 	b.PluginChatChannels[name] = &chatChannel
 	b.pccMutex.Unlock()
@@ -178,16 +212,20 @@ func (b *Bot) RegisterPlugin(p *Plugin, name string) error {
 	b.ppcMutex.Unlock()
 
 	b.Plugins = append(b.Plugins, p)
+	b.router.add(p, configPrefix)
 	p.listen()
 	return nil
 }
 
 // RegisterPlugins registers a slice of plugins in one call.
 // The map should be formatted with pairs of "plugin name"=>*Plugin.
+// Stops at and returns the first error.
 func (b *Bot) RegisterPlugins(plugins map[string]*Plugin) error {
 	for name, p := range plugins {
 		err := b.RegisterPlugin(p, name)
-		CheckErr(err)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -196,13 +234,13 @@ func (b *Bot) RegisterPlugins(plugins map[string]*Plugin) error {
 // Timed plugins are not started until the bot is logged in.
 func (b *Bot) RegisterTimedPlugin(tp *TimedPlugin, name string) error {
 	for _, plugin := range b.TimedPlugins {
-		if plugin.Name == tp.Name {
-			Error(ErrPluginNameAlreadyRegistered)
+		if plugin.Name == name {
 			return ErrPluginNameAlreadyRegistered
 		}
 	}
-	Debugf("[on bot] Registering timed plugin `%s` with period `%f`", name, tp.Period)
+	Debugf("[on bot] Registering timed plugin `%s` with period `%v`", name, tp.Period)
 	tp.Bot = b
+	tp.Name = name
 	b.TimedPlugins = append(b.TimedPlugins, tp)
 	return nil
 }
@@ -213,6 +251,7 @@ func (b *Bot) UnregisterPlugin(p *Plugin) bool {
 	for i, plugin := range b.Plugins {
 		if plugin == p {
 			Debugf("[on bot] Unregistering plugin `%s`", p.Name)
+			b.router.remove(p)
 			p.stopListening()
 			delete(b.PluginChatChannels, p.Name)
 			delete(b.PluginPrivateChannels, p.Name)
@@ -258,16 +297,24 @@ func (b *Bot) StopTimedPlugins() {
 	}
 }
 
-func (b *Bot) pluginChatChannelsWrite(s string, m *Message) {
+// The channels are written to without holding their mutex, so that a slow
+// plugin cannot hold up the others. See Plugin.deliver.
+func (b *Bot) pluginChatChannelsWrite(p *Plugin, m *Message) {
 	b.pccMutex.Lock()
-	*b.PluginChatChannels[s] <- m
+	ch := b.PluginChatChannels[p.Name]
 	b.pccMutex.Unlock()
+	if ch != nil {
+		p.deliver(*ch, m)
+	}
 }
 
-func (b *Bot) pluginPrivateChannelsWrite(s string, m *Message) {
+func (b *Bot) pluginPrivateChannelsWrite(p *Plugin, m *Message) {
 	b.ppcMutex.Lock()
-	*b.PluginPrivateChannels[s] <- m
+	ch := b.PluginPrivateChannels[p.Name]
 	b.ppcMutex.Unlock()
+	if ch != nil {
+		p.deliver(*ch, m)
+	}
 }
 
 func (b *Bot) pluginChatChannelsRead(s string) chan *Message {
@@ -309,12 +356,86 @@ func (b *Bot) Synchronize(name string, lambda *func() interface{}) interface{} {
 	return (*lambda)()
 }
 
-// Connect starts the bot and connects to the websocket.
-func (b *Bot) Connect() {
-	b.Connection.connect()
+// Run connects to the websocket and blocks until the context is cancelled,
+// the bot is shut down, or the bot runs into an error it cannot recover from.
+// Cancelling the context shuts the bot down as Shutdown does, waiting at most
+// the ShutdownTimeout of the Config, and returns the context's error. Returns
+// nil if the bot was shut down with Shutdown.
+//
+// The returned errors wrap ErrDialFailed if the first connection could not
+// be made, and ErrMaxReconnectAttempts if a dropped connection could not be
+// restored. If the bot could not log in, a *LoginError is returned, which
+// matches ErrLoginFailed as well as the more specific ErrNameTaken,
+// ErrBadPassword or ErrLoginRateLimited. Use errors.Is to tell them apart.
+func (b *Bot) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.Connection.connect(ctx)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		timeout := time.Duration(b.Config.ShutdownTimeout * float64(time.Second))
+		sctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		b.reportError(b.Shutdown(sctx))
+		return ctx.Err()
+	}
+}
+
+// Shutdown gracefully stops the bot. Timed plugins are stopped, the outgoing
+// message queue is drained, a close frame is sent to the server and plugins
+// stop listening. If the context expires before this is done, the connection
+// is closed forcibly and the context's error is returned. A Bot cannot be run
+// again after it was shut down.
+func (b *Bot) Shutdown(ctx context.Context) error {
+	b.StopTimedPlugins()
+	err := b.Connection.close(ctx)
+	b.Connection.outbox.clear(ErrConnectionClosed)
+	for _, p := range b.Plugins {
+		p.stopListening()
+	}
+	return err
 }
 
-// Send queues a string onto the outgoing message queue.
-func (b *Bot) Send(s string) {
-	b.Connection.QueueMessage(s)
+// Connect starts the bot and connects to the websocket. It blocks until the
+// process is interrupted, after which the bot is shut down. Use Run instead to
+// control the lifecycle of the bot yourself. Returns the errors described by
+// Run, except that an interruption is not an error.
+func (b *Bot) Connect() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := b.Run(ctx)
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// Send queues a string onto the outgoing message queue. Returns a handle that
+// can be used to cancel the message or to wait until it has been sent.
+func (b *Bot) Send(s string) *OutgoingMessage {
+	return b.Connection.QueueMessage(s)
+}
+
+// SendWithPriority queues a string onto the outgoing message queue with the
+// given priority, ahead of any message of a lower priority.
+func (b *Bot) SendWithPriority(s string, p Priority) *OutgoingMessage {
+	return b.Connection.QueueMessageWithPriority(s, p)
+}
+
+// Command runs a server command in a room, or outside of any room if the room
+// is empty. The name may start with / or ! and is run with / otherwise, such
+// as "roomban" or "!dt". The arguments are joined with commas, and may not
+// start another command. Returns ErrInvalidCommand if the name is not a
+// single word.
+func (b *Bot) Command(room string, name string, args ...string) (*OutgoingMessage, error) {
+	cmd, err := formatCommand(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return b.Connection.QueueMessage(fmt.Sprintf("%s|%s", room, cmd)), nil
 }
@@ -0,0 +1,171 @@
+package sdbot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBotsAreIsolated tests that two bots in the same process do not share
+// their loggers or their user and room state.
+func TestBotsAreIsolated(t *testing.T) {
+	b1 := initBot()
+	b2 := initBot()
+
+	var buf bytes.Buffer
+	b1.AddLogger(&DefaultLogger{AnyLogger{Output: &buf}})
+
+	if len(b1.Loggers.Loggers) != 2 {
+		t.Errorf(`len(b1.Loggers.Loggers) (%d) should == 2`, len(b1.Loggers.Loggers))
+	}
+	if len(b2.Loggers.Loggers) != 1 {
+		t.Errorf(`len(b2.Loggers.Loggers) (%d) should == 1`, len(b2.Loggers.Loggers))
+	}
+
+	b1.Connection.parse(">testroom\n|J|+Tympy", false)
+
+	if buf.Len() == 0 {
+		t.Error(`b1's logger should have logged the incoming message`)
+	}
+	if b1.UserList["tympy"] == nil {
+		t.Error(`user "tympy" should be known to b1`)
+	}
+	if b2.UserList["tympy"] != nil {
+		t.Error(`user "tympy" should not be known to b2`)
+	}
+	if b2.RoomList["testroom"] != nil {
+		t.Error(`room "testroom" should not be known to b2`)
+	}
+}
+
+// TestDeprecatedLoggers tests that loggers added with the package level
+// AddLogger log for the bots created after it, and for ErrorAll.
+func TestDeprecatedLoggers(t *testing.T) {
+	var buf bytes.Buffer
+	lo := &DefaultLogger{AnyLogger{Output: &buf}}
+	AddLogger(lo)
+	b := initBot()
+	if !RemoveLogger(lo) {
+		t.Error(`RemoveLogger(lo) should == true`)
+	}
+
+	if len(b.Loggers.Loggers) != 2 {
+		t.Errorf(`len(b.Loggers.Loggers) (%d) should == 2`, len(b.Loggers.Loggers))
+	}
+	b.AddLogger(&DefaultLogger{AnyLogger{Output: &buf}})
+	if len(defaultLoggers.Loggers) != 1 {
+		t.Errorf(`len(defaultLoggers.Loggers) (%d) should == 1`, len(defaultLoggers.Loggers))
+	}
+
+	AddLogger(lo)
+	CheckErrAll(errors.New("oops"))
+	RemoveLogger(lo)
+	if !strings.Contains(buf.String(), "oops") {
+		t.Errorf(`buf (%q) should contain "oops"`, buf.String())
+	}
+}
+
+// TestNewBotMissingConfig tests that NewBot returns an error instead of a bot
+// when the config file does not exist.
+func TestNewBotMissingConfig(t *testing.T) {
+	b, err := NewBot("examples/config/missing.toml")
+	if err == nil {
+		t.Error(`err should != nil`)
+	}
+	if b != nil {
+		t.Error(`b should == nil`)
+	}
+}
+
+// TestRegisterPluginInvalidCommand tests that a plugin with a command that is
+// not a valid regexp is refused.
+func TestRegisterPluginInvalidCommand(t *testing.T) {
+	b := initBot()
+	p := NewPlugin("(unclosed")
+	if err := b.RegisterPlugin(p, "invalid"); err == nil {
+		t.Error(`err should != nil`)
+	}
+	if len(b.Plugins) != 0 {
+		t.Errorf(`len(b.Plugins) (%d) should == 0`, len(b.Plugins))
+	}
+}
+
+// TestShutdownNotStarted tests that a bot that was never run shuts down right
+// away.
+func TestShutdownNotStarted(t *testing.T) {
+	b := initBot()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := b.Shutdown(ctx); err != nil {
+		t.Errorf(`b.Shutdown (%v) should == nil`, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf(`b.Shutdown took %v, should return right away`, elapsed)
+	}
+}
+
+// TestRunShutdown tests that cancelling the context of Run drains the
+// outgoing queue, sends a close frame and makes Run return.
+func TestRunShutdown(t *testing.T) {
+	b, ft := initFakeBot()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- b.Run(ctx) }()
+	ft.waitFor(t, "|/join techcode")
+
+	queued := []string{"|/msg a, 1", "|/msg a, 2", "|/msg a, 3", "|/msg a, 4", "|/msg a, 5"}
+	for _, msg := range queued {
+		b.Connection.QueueMessage(msg)
+	}
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf(`err (%v) should == context.Canceled`, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Run should have returned`)
+	}
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	for _, msg := range queued {
+		if !includes(ft.writes, msg) {
+			t.Errorf(`%q should have been sent before closing`, msg)
+		}
+	}
+	if ft.closeFrames != 1 {
+		t.Errorf(`ft.closeFrames (%d) should == 1`, ft.closeFrames)
+	}
+}
+
+// TestShutdownTimeout tests that Shutdown gives up waiting for the server to
+// close the connection once its context expires, and closes it itself.
+func TestShutdownTimeout(t *testing.T) {
+	b, ft := initFakeBot()
+	ft.ignoreClose = true
+	errc := make(chan error, 1)
+	go func() { errc <- b.Run(context.Background()) }()
+	ft.waitFor(t, "|/join techcode")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf(`b.Shutdown (%v) should == context.DeadlineExceeded`, err)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf(`err (%v) should == nil`, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Run should have returned once the connection was closed`)
+	}
+}
@@ -1,6 +1,7 @@
 package sdbot
 
 import (
+	"fmt"
 	"os"
 	"regexp"
 	"strings"
@@ -10,63 +11,236 @@ import (
 
 // Config holds the configuration information read from the config.toml file.
 type Config struct {
-	Server                string
-	Port                  string
-	Nick                  string
-	Password              string
-	MessagesPerSecond     float64
-	Rooms                 []string
-	Avatar                int
-	PluginPrefixes        []string
-	PluginSuffixes        []string
-	PluginPrefix          *regexp.Regexp
-	PluginSuffix          *regexp.Regexp
-	CaseInsensitive       bool
-	IgnorePrivateMessages bool
-	IgnoreChatMessages    bool
+	Server                   string
+	Port                     string
+	Transport                string
+	Scheme                   string
+	Path                     string
+	Origin                   string
+	Headers                  map[string]string
+	TLSCAFile                string
+	TLSInsecureSkipVerify    bool
+	Proxy                    string
+	HandshakeTimeout         float64
+	EnableCompression        bool
+	LoginServer              string
+	Nick                     string
+	Password                 string
+	MessagesPerSecond        float64
+	MessageBurst             int
+	PrivateMessagesPerSecond float64
+	PrivateMessageBurst      int
+	ThrottleCooldown         float64
+	MaxMessageLength         int
+	MaxReplyChunks           int
+	MultilineReplies         string
+	AllowRawCommands         bool
+	Rooms                    []string
+	Avatar                   int
+	PluginPrefixes           []string
+	PluginSuffixes           []string
+	PluginPrefix             *regexp.Regexp
+	PluginSuffix             *regexp.Regexp
+	CaseInsensitive          bool
+	IgnorePrivateMessages    bool
+	IgnoreChatMessages       bool
+	PluginQueueLength        int
+	PluginOverflow           string
+	PluginBlockTimeout       float64
+	PluginConcurrency        int
+	PluginTimeout            float64
+	PluginPanicReply         string
+	PluginMaxPanics          int
+	PluginCooldownReply      string
+	Owners                   []string
+	AuthRoom                 string
+	AuthDenialReply          string
+	PolicyFile               string
+	Roles                    map[string][]string
+	PluginWhitelists         map[string][]string
+	RoomBlacklists           map[string][]string
+	ReconnectMaxAttempts     int
+	ReconnectDelay           float64
+	ReconnectMaxDelay        float64
+	ReconnectMultiplier      float64
+	ReconnectJitter          float64
+	ShutdownTimeout          float64
 }
 
 // Reads the config data from toml config file.
-func readConfig(path string) *Config {
+func readConfig(path string) (*Config, error) {
 	_, err := os.Stat(path)
 	if err != nil {
-		Fatalf("Config file is missing: %s", path)
+		return nil, fmt.Errorf("sdbot: config file is missing: %w", err)
 	}
 
 	var config Config
 	_, err = toml.DecodeFile(path, &config)
-	CheckErr(err)
+	if err != nil {
+		return nil, fmt.Errorf("sdbot: could not decode config file: %w", err)
+	}
+
+	err = config.generatePluginPrefixRegexp()
+	if err != nil {
+		return nil, err
+	}
+	err = config.generatePluginSuffixRegexp()
+	if err != nil {
+		return nil, err
+	}
+
+	config.Scheme = strings.ToLower(config.Scheme)
+	switch config.Scheme {
+	case "":
+		config.Scheme = "ws"
+	case "ws", "wss":
+	default:
+		return nil, fmt.Errorf("sdbot: invalid websocket scheme %q (use ws or wss)", config.Scheme)
+	}
+
+	config.Transport = strings.ToLower(config.Transport)
+	switch config.Transport {
+	case "":
+		config.Transport = TransportWebsocket
+	case TransportWebsocket, TransportSockJS:
+	default:
+		return nil, ErrUnknownTransport
+	}
+
+	if config.Path == "" {
+		if config.Transport == TransportSockJS {
+			config.Path = "/showdown"
+		} else {
+			config.Path = "/showdown/websocket"
+		}
+	}
+
+	if config.Origin == "" {
+		config.Origin = "https://play.pokemonshowdown.com"
+	}
 
-	config.generatePluginPrefixRegexp()
-	config.generatePluginSuffixRegexp()
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = 45
+	}
+
+	if config.LoginServer == "" {
+		config.LoginServer = DefaultLoginServer
+	}
 
 	if config.MessagesPerSecond == 0 {
 		config.MessagesPerSecond = 3
 	}
 
-	return &config
+	if config.MessageBurst == 0 {
+		config.MessageBurst = 3
+	}
+
+	if config.PrivateMessagesPerSecond == 0 {
+		config.PrivateMessagesPerSecond = config.MessagesPerSecond
+	}
+
+	if config.PrivateMessageBurst == 0 {
+		config.PrivateMessageBurst = config.MessageBurst
+	}
+
+	if config.ThrottleCooldown == 0 {
+		config.ThrottleCooldown = 30
+	}
+
+	if config.MaxMessageLength == 0 {
+		config.MaxMessageLength = 300
+	}
+
+	if config.MaxReplyChunks == 0 {
+		config.MaxReplyChunks = 3
+	}
+
+	config.MultilineReplies = strings.ToLower(config.MultilineReplies)
+	switch config.MultilineReplies {
+	case "":
+		config.MultilineReplies = MultilineSplit
+	case MultilineSplit, MultilineCode, MultilineHTMLBox:
+	default:
+		return nil, fmt.Errorf("sdbot: invalid MultilineReplies %q (use split, code or htmlbox)", config.MultilineReplies)
+	}
+
+	if config.PluginQueueLength == 0 {
+		config.PluginQueueLength = 64
+	}
+
+	config.PluginOverflow = strings.ToLower(config.PluginOverflow)
+	if config.PluginOverflow == "" {
+		config.PluginOverflow = OverflowBlock
+	}
+	if !validOverflow(config.PluginOverflow) {
+		return nil, ErrUnknownOverflow
+	}
+
+	if config.PluginBlockTimeout == 0 {
+		config.PluginBlockTimeout = 1
+	}
+
+	if config.PluginConcurrency == 0 {
+		config.PluginConcurrency = 4
+	}
+
+	if config.PluginTimeout == 0 {
+		config.PluginTimeout = 30
+	}
+
+	if config.PluginMaxPanics == 0 {
+		config.PluginMaxPanics = 3
+	}
+
+	for i, owner := range config.Owners {
+		config.Owners[i] = Sanitize(owner)
+	}
+
+	if config.ReconnectDelay == 0 {
+		config.ReconnectDelay = 3
+	}
+
+	if config.ReconnectMaxDelay == 0 {
+		config.ReconnectMaxDelay = 300
+	}
+
+	if config.ReconnectMultiplier == 0 {
+		config.ReconnectMultiplier = 2
+	}
+
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 5
+	}
+
+	return &config, nil
 }
 
-func (c *Config) generatePluginPrefixRegexp() {
+func (c *Config) generatePluginPrefixRegexp() error {
 	var prefixes []string
 	for _, prefix := range c.PluginPrefixes {
 		prefixes = append(prefixes, regexp.QuoteMeta(prefix))
 	}
 	regStr := "^(" + strings.Join(prefixes, "|") + ")"
 	reg, err := regexp.Compile(regStr)
-	CheckErr(err)
+	if err != nil {
+		return err
+	}
 
 	c.PluginPrefix = reg
+	return nil
 }
 
-func (c *Config) generatePluginSuffixRegexp() {
+func (c *Config) generatePluginSuffixRegexp() error {
 	var suffixes []string
 	for _, suffix := range c.PluginSuffixes {
 		suffixes = append(suffixes, regexp.QuoteMeta(suffix))
 	}
 	regStr := "(" + strings.Join(suffixes, "|") + ")$"
 	reg, err := regexp.Compile(regStr)
-	CheckErr(err)
+	if err != nil {
+		return err
+	}
 
 	c.PluginSuffix = reg
+	return nil
 }
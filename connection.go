@@ -1,177 +1,386 @@
 package sdbot
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
-	"os"
-	"os/signal"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/mikopits/sdbot/protocol"
 	"github.com/mikopits/sdbot/utilities"
 )
 
-// LoginTime contains the unix login times as values to each particular room
-// the bot has joined. This allows us to ignore messages that occurred before
-// the bot has logged in.
-var LoginTime map[string]int = make(map[string]int)
-
-var interrupt chan os.Signal
-
-// Connection represents the connection to the websocket.
+// Connection represents the connection to the server. The Transport is chosen
+// by the Config, and may be replaced before the bot is run. LoginTime contains
+// the unix login times as values to each particular room the bot has joined.
+// This allows us to mark messages that occurred before the bot has logged in
+// as backlog.
 type Connection struct {
-	Bot       *Bot
-	Connected bool
-	LoginTime map[string]int
-	conn      *websocket.Conn
-	queue     chan string
-	reconnect chan struct{}
+	Bot             *Bot
+	Connected       bool
+	LoginTime       map[string]int
+	Transport       Transport
+	outbox          *outbox
+	limiter         *RateLimiter
+	backoff         *Backoff
+	restoreAttempts int
+	closing         chan struct{}
+	closeOnce       sync.Once
+	drain           chan context.Context
+	started         chan struct{}
+	stopped         chan struct{}
+	failMutex       sync.Mutex
+	failErr         error
 }
 
 // NewConnection creates a new connection for a bot.
 func NewConnection(b *Bot) *Connection {
 	return &Connection{
 		Bot:       b,
+		Transport: newTransport(b.Config),
 		LoginTime: make(map[string]int),
-		queue:     make(chan string, 64),
-		reconnect: make(chan struct{}),
+		outbox:    newOutbox(),
+		limiter:   NewRateLimiter(b.Config),
+		backoff:   NewBackoff(b.Config),
+		closing:   make(chan struct{}),
+		drain:     make(chan context.Context),
+		started:   make(chan struct{}),
+		stopped:   make(chan struct{}),
 	}
 }
 
-// Connects to the server websocket and initialize reading and writing threads.
-func (c *Connection) connect() {
-	host := c.Bot.Config.Server + ":" + c.Bot.Config.Port
-	u := url.URL{Scheme: "ws", Host: host, Path: "/showdown/websocket"}
-	Info(fmt.Sprintf("Connecting to %s...", u.String()))
+// ErrDialFailed is returned when the first connection to the server could not
+// be made.
+var ErrDialFailed = errors.New("sdbot: could not connect to the server")
+
+// Connects to the server websocket and supervises the connection. Whenever
+// the connection drops, the OnDisconnect hooks are called and the connection
+// is retried according to the reconnect policy in the Config. Failed reconnect
+// attempts are only logged. Returns nil once the connection was closed on
+// purpose, or an error if the first connection could not be made, the
+// connection failed, or the policy gives up.
+func (c *Connection) connect(ctx context.Context) error {
+	defer close(c.stopped)
+	close(c.started)
+	if c.isClosing() {
+		return nil
+	}
+
+	connected := false
+	for {
+		err := c.dial(ctx)
+		switch {
+		case err != nil && !connected:
+			return fmt.Errorf("%w: %v", ErrDialFailed, err)
+		case err != nil:
+			if c.isClosing() {
+				return nil
+			}
+			Warnf("connection: reconnect attempt %d failed: %v", c.backoff.Attempts(), err)
+		default:
+			connected = true
+			if c.backoff.Attempts() > 0 {
+				c.restoreAttempts = c.backoff.Attempts()
+			}
+			c.backoff.Reset()
+			err = c.run()
+
+			if c.isClosing() {
+				return nil
+			}
+			if err := c.failure(); err != nil {
+				return err
+			}
+
+			Warnf("connection: lost connection to the server: %v", err)
+			c.Bot.StopTimedPlugins()
+			c.Bot.disconnected(err)
+		}
+
+		delay, ok := c.backoff.Next()
+		if !ok {
+			return fmt.Errorf("%w: %v", ErrMaxReconnectAttempts, err)
+		}
+		Debugf("connection: waiting %v before reconnect attempt %d.", delay, c.backoff.Attempts())
+		select {
+		case <-time.After(delay):
+		case <-c.closing:
+			return nil
+		}
+	}
+}
 
-	var res *http.Response
-	var err error
-	dialer := websocket.DefaultDialer
-	c.conn, res, err = dialer.Dial(u.String(), http.Header{
-		"Origin": []string{"https://play.pokemonshowdown.com"},
-	})
-	CheckErr(err)
+// Dials the server with the Connection's Transport.
+func (c *Connection) dial(ctx context.Context) error {
+	err := c.Transport.Dial(ctx, c.Bot.Config)
+	if err != nil {
+		return err
+	}
 
 	c.Connected = true
+	c.LoginTime = make(map[string]int)
+	return nil
+}
+
+// Runs the reading and writing threads for a single connection and blocks
+// until the connection fails. Returns the error that ended the connection.
+func (c *Connection) run() error {
+	errc := make(chan error, 1)
+	done := make(chan struct{})
 
-	defer res.Body.Close()
-	defer c.conn.Close()
+	c.startReading(errc)
+	c.startSending(done)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	c.startReading()
-	c.startSending()
-	defer wg.Done()
-	wg.Wait()
+	err := <-errc
+	close(done)
+	c.Transport.Close()
+	c.Connected = false
+	return err
+}
+
+// Stops the connection because of an error that reconnecting would not fix,
+// such as a failed login. The error is returned by Run.
+func (c *Connection) fail(err error) {
+	c.failMutex.Lock()
+	if c.failErr == nil {
+		c.failErr = err
+	}
+	c.failMutex.Unlock()
+
+	c.Transport.Close()
+}
+
+// Returns the error the connection was failed with, if any.
+func (c *Connection) failure() error {
+	c.failMutex.Lock()
+	defer c.failMutex.Unlock()
+	return c.failErr
+}
+
+// Returns true once the connection has been asked to close.
+func (c *Connection) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closes the connection gracefully. The outgoing queue is drained, a close
+// frame is sent and we wait for the server to close the connection. If the
+// context expires first, the socket is closed forcibly and the context's
+// error is returned. Returns nil right away if the connection was never
+// started.
+func (c *Connection) close(ctx context.Context) error {
+	c.closeOnce.Do(func() { close(c.closing) })
+
+	// The supervisor checks that we are closing once it has started, so it
+	// either stops by itself or is waited for below.
+	select {
+	case <-c.started:
+	default:
+		return nil
+	}
+
+	// Hand the context to the sending goroutine, if one is running. Otherwise
+	// the supervisor will notice that we are closing and stop by itself.
+	select {
+	case c.drain <- ctx:
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+	}
+
+	select {
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+		c.Transport.Close()
+		return ctx.Err()
+	}
 }
 
 // ErrUnexpectedMessageType is returned when we receive a message from the
 // websocket that isn't a websocket.TextMessage or a normal closure.
 var ErrUnexpectedMessageType = errors.New("sdbot: unexpected message type from the websocket")
 
-// Listens for messages from the websocket.
-// TODO gracefully break out of this loop on interrupt.
-func (c *Connection) startReading() {
+// Listens for messages from the websocket. The error that stops the loop is
+// sent on errc.
+func (c *Connection) startReading(errc chan<- error) {
 	go func() {
 		for {
-			_, msg, err := c.conn.ReadMessage()
-			CheckErr(err)
-
-			if websocket.IsCloseError(err, 1000) {
-				return
-			} else if websocket.IsCloseError(err, 1006) {
-				c.reconnect <- struct{}{}
+			frames, err := c.Transport.Read()
+			if err != nil {
+				errc <- err
 				return
 			}
 
-			var room string
-			msgs := strings.Split(string(msg), "\n")
-
-			if string(msgs[0][0]) == ">" {
-				room, msgs = msgs[0], msgs[1:]
-			}
-
-			for _, raw := range msgs {
-				s, err := utilities.Encode(raw, utilities.UTF8)
-				CheckErr(err)
-				c.parse(fmt.Sprintf("%s\n%s", room, s))
+			for _, frame := range frames {
+				c.readFrame(frame)
 			}
 		}
 	}()
 }
 
-// Initiates the message sending goroutine.
-func (c *Connection) startSending() {
-	go func() {
-		interrupt = make(chan os.Signal, 1)
-		signal.Notify(interrupt, os.Interrupt)
-		done := make(chan struct{})
+// Splits a frame into its lines and parses each of them. A frame starting with
+// ">" is sent from the room named on its first line. The frame the server
+// sends when the bot joins a room starts with |init|, and holds the title and
+// users of the room along with its chat backlog.
+func (c *Connection) readFrame(frame string) {
+	var room string
+	msgs := strings.Split(frame, "\n")
+
+	if len(msgs[0]) > 0 && string(msgs[0][0]) == ">" {
+		room, msgs = msgs[0], msgs[1:]
+	}
+	init := len(msgs) > 0 && strings.HasPrefix(msgs[0], "|init|")
 
+	for _, raw := range msgs {
+		s, err := utilities.Encode(raw, utilities.UTF8)
+		c.Bot.reportError(err)
+		c.parse(fmt.Sprintf("%s\n%s", room, s), init)
+	}
+}
+
+// Initiates the message sending goroutine. Messages are sent as soon as the
+// RateLimiter allows. It stops once done is closed, or once it has drained the
+// queue and sent a close frame on request of close.
+func (c *Connection) startSending(done <-chan struct{}) {
+	go func() {
 		for {
 			select {
-			case msg := <-c.queue:
-				send(c, msg)
-				ms := 1000.0 / c.Bot.Config.MessagesPerSecond
-				time.Sleep(time.Duration(ms) * time.Millisecond)
-			case <-c.reconnect:
-				Debug("connection: waiting 3 seconds before reconnect attempt.")
-				time.Sleep(time.Second * 3)
-				c.Bot.Connect()
+			case <-done:
+				return
+			default:
+			}
+
+			om, wait := c.outbox.pop(c.limiter, time.Now())
+			if om != nil {
+				c.sendQueued(om)
+				continue
+			}
+
+			var retry <-chan time.Time
+			if wait > 0 {
+				retry = time.After(wait)
+			}
+
+			select {
+			case <-c.outbox.notify:
+			case <-retry:
+			case <-done:
 				return
-			case <-interrupt:
-				Warn("Process was interrupted. Closing connection...")
-
-				// Send a close frame and wait for the server to close the connection.
-				err := c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-				if err != nil {
-					Error(err)
-					return
-				}
-
-				select {
-				case <-done:
-				case <-time.After(time.Second):
-					os.Exit(0)
-				}
-				c.conn.Close()
-				c.Connected = false
+			case ctx := <-c.drain:
+				Info("Closing connection...")
+				c.drainQueue(ctx)
+
+				// Send a close frame and let the server close the connection.
+				c.Bot.reportError(c.Transport.WriteClose())
 				return
 			}
 		}
 	}()
 }
 
-// QueueMessage adds a message to the outgoing queue.
-func (c *Connection) QueueMessage(msg string) {
-	c.queue <- msg
+// Sends everything left in the outgoing queue, or as much of it as the
+// context allows.
+func (c *Connection) drainQueue(ctx context.Context) {
+	for {
+		om, wait := c.outbox.pop(c.limiter, time.Now())
+		if om != nil {
+			c.sendQueued(om)
+			continue
+		}
+		if wait == 0 {
+			return
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sends a message taken from the outgoing queue and fires its receipt.
+func (c *Connection) sendQueued(om *OutgoingMessage) {
+	err := send(c, om.Text)
+	c.outbox.sent(om, err)
+	c.Bot.reportError(err)
+}
+
+// QueueMessage adds a message to the outgoing queue with a priority picked by
+// the command it runs, if any (see Priority). It never blocks, and returns a
+// handle to the queued message.
+func (c *Connection) QueueMessage(msg string) *OutgoingMessage {
+	return c.outbox.push(msg, messagePriority(msg))
+}
+
+// QueueMessageWithPriority adds a message to the outgoing queue with the
+// given priority. It never blocks, and returns a handle to the queued message.
+func (c *Connection) QueueMessageWithPriority(msg string, p Priority) *OutgoingMessage {
+	return c.outbox.push(msg, p)
 }
 
 // Sends a message upstream to the websocket ignoring the message queue.
-func send(c *Connection, s string) {
+func send(c *Connection, s string) error {
 	enc, err := utilities.Encode(s, utilities.UTF8)
-	CheckErr(err)
-	logOutgoingAll(loggers, s)
+	if err != nil {
+		return err
+	}
+	logOutgoingAll(c.Bot.Loggers, s)
 
-	err = c.conn.WriteMessage(websocket.TextMessage, []byte(enc))
-	CheckErr(err)
+	return c.Transport.Write(enc)
 }
 
-// Parses the message and difers it to a relevant handler.
-func (c *Connection) parse(s string) {
+// Parses the message and difers it to a relevant handler. Chat messages are
+// marked as backlog if they were part of the frame sent when the bot joined
+// the room.
+func (c *Connection) parse(s string, backlog bool) {
 	m := NewMessage(s, c.Bot)
 
 	// Log the incoming messages to every logger.
-	logIncomingAll(loggers, s)
+	logIncomingAll(c.Bot.Loggers, s)
+
+	// Malformed lines are not handled, so that no handler has to check for
+	// missing parts.
+	if m.parseErr != nil {
+		Warn(m.parseErr.Error())
+		return
+	}
 
 	cmd := strings.ToLower(m.Command)
 
 	if cmd == ":" {
 		c.LoginTime[m.Room.Name] = m.Timestamp
 	}
+	if chat, ok := m.Parsed.(*protocol.Chat); ok {
+		m.Backlog = backlog || c.beforeLogin(m.Room.Name, chat)
+	}
 
-	callHandler(handlers, cmd, m)
+	// The server tells us that it dropped a message in a popup or a raw line.
+	// Chat is not checked, so that users cannot slow the bot down.
+	switch cmd {
+	case "none", "raw", "popup", "error":
+		if strings.Contains(s, throttleNotice) {
+			c.limiter.throttled(time.Now())
+		}
+	}
+
+	c.Bot.dispatch(cmd, m)
+}
+
+// Returns true if a chat message was sent before the bot joined the room, as
+// told by its timestamp. Messages without a timestamp, as sent in battles, are
+// only backlog if they were part of the frame sent when the bot joined.
+func (c *Connection) beforeLogin(room string, chat *protocol.Chat) bool {
+	if strings.ToLower(chat.Type) != "c:" {
+		return false
+	}
+	loginTime := c.LoginTime[room]
+	return loginTime == 0 || chat.Timestamp < int64(loginTime)
 }
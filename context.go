@@ -0,0 +1,114 @@
+package sdbot
+
+import (
+	"context"
+	"fmt"
+)
+
+// HandlerFunc handles an event of a Plugin. The Context carries everything
+// about the event, and the error returned, if any, is reported to the OnError
+// hooks along with the name of the plugin. Set it with Plugin.SetHandler.
+type HandlerFunc func(c *Context) error
+
+// Context is passed to a HandlerFunc for every event of a Plugin. It is a
+// context.Context that expires after the Timeout of the plugin, and is
+// cancelled when the plugin is stopped, so it can be passed on to anything
+// that takes one. Values holds the arguments parsed with the Args of the
+// plugin, if it has any, and Args the arguments as they were given.
+type Context struct {
+	context.Context
+	Bot     *Bot
+	Plugin  *Plugin
+	Message *Message
+	Args    []string
+	Values  ArgValues
+	Log     *PluginLogger
+}
+
+// Reply responds to the message in the room or private message it came from.
+func (c *Context) Reply(res string) {
+	c.Message.Reply(res)
+}
+
+// Replyf is Reply with a format string.
+func (c *Context) Replyf(format string, a ...interface{}) {
+	c.Message.Reply(fmt.Sprintf(format, a...))
+}
+
+// RawReply responds to the message without a prefix.
+func (c *Context) RawReply(res string) {
+	c.Message.RawReply(res)
+}
+
+// Command runs a command of the server where the message came from.
+func (c *Context) Command(name string, args ...string) error {
+	return c.Message.RunCommand(name, args...)
+}
+
+// Arg returns the nth argument of the event, or an empty string if there are
+// not that many.
+func (c *Context) Arg(n int) string {
+	if n < 0 || n >= len(c.Args) {
+		return ""
+	}
+	return c.Args[n]
+}
+
+// PluginLogger logs to all the loggers in the LoggerList of the bot with the
+// name of the plugin in front of every message.
+type PluginLogger struct {
+	bot  *Bot
+	name string
+}
+
+// Returns the loggers of the bot, or the default logger if there is no bot.
+func (l *PluginLogger) loggers() *LoggerList {
+	if l.bot == nil || l.bot.Loggers == nil {
+		return NewLoggerList(defaultLogger)
+	}
+	return l.bot.Loggers
+}
+
+// Debugf logs a debug message of the plugin.
+func (l *PluginLogger) Debugf(format string, a ...interface{}) {
+	logDebugAllf(l.loggers(), "[plugin %s] %s", l.name, fmt.Sprintf(format, a...))
+}
+
+// Infof logs an informatic message of the plugin.
+func (l *PluginLogger) Infof(format string, a ...interface{}) {
+	logInfoAllf(l.loggers(), "[plugin %s] %s", l.name, fmt.Sprintf(format, a...))
+}
+
+// Warnf logs a warning of the plugin.
+func (l *PluginLogger) Warnf(format string, a ...interface{}) {
+	logWarnAllf(l.loggers(), "[plugin %s] %s", l.name, fmt.Sprintf(format, a...))
+}
+
+// Errorf logs an error of the plugin.
+func (l *PluginLogger) Errorf(format string, a ...interface{}) {
+	logErrorAllf(l.loggers(), "[plugin %s] %s", l.name, fmt.Sprintf(format, a...))
+}
+
+// Adapt turns an EventHandler into a HandlerFunc. A ContextEventHandler is
+// passed the context of the event. The HandlerFunc never returns an error.
+func Adapt(eh EventHandler) HandlerFunc {
+	if ceh, ok := eh.(ContextEventHandler); ok {
+		return func(c *Context) error {
+			ceh.HandleEventContext(c.Context, c.Message, c.Args)
+			return nil
+		}
+	}
+	return func(c *Context) error {
+		eh.HandleEvent(c.Message, c.Args)
+		return nil
+	}
+}
+
+// Returns the HandlerFunc of the plugin, adapting its EventHandler if it has
+// no Handler.
+func (p *Plugin) handler() HandlerFunc {
+	if p.Handler != nil {
+		return p.Handler
+	}
+	return Adapt(p.EventHandler)
+}
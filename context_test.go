@@ -0,0 +1,84 @@
+package sdbot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHandlerFunc tests that a HandlerFunc is passed the message, arguments
+// and plugin of the event, and that the error it returns is reported.
+func TestHandlerFunc(t *testing.T) {
+	b := initBot()
+	errs := make(chan error, 1)
+	b.OnError(func(err error) { errs <- err })
+
+	errTest := errors.New("test error")
+	contexts := make(chan *Context, 1)
+	p := NewPluginWithArgs("ctx", 1)
+	p.SetHandler(func(c *Context) error {
+		contexts <- c
+		return errTest
+	})
+	if err := b.RegisterPlugin(p, "ctx"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	b.pluginChatChannelsWrite(p, &Message{Bot: b, Message: ".ctx hi"})
+
+	select {
+	case c := <-contexts:
+		if c.Plugin != p || c.Bot != b || c.Message.Message != ".ctx hi" {
+			t.Errorf(`c (%+v) should carry the plugin, bot and message`, c)
+		}
+		if c.Arg(0) != "hi" || c.Arg(1) != "" {
+			t.Errorf(`c.Args (%v) should == [hi]`, c.Args)
+		}
+		if _, ok := c.Deadline(); !ok {
+			t.Error(`c should have a deadline`)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`the handler should have been called`)
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, errTest) {
+			t.Errorf(`err (%v) should wrap errTest`, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`the error should have been reported`)
+	}
+}
+
+// TestAdapt tests that an adapted EventHandler is passed the message and
+// arguments, and that a ContextEventHandler is passed the context.
+func TestAdapt(t *testing.T) {
+	eh := &contextEventHandler{err: make(chan error, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := &Context{Context: ctx, Message: &Message{}}
+	if err := Adapt(eh)(c); err != nil {
+		t.Errorf(`Adapt(eh)(c) (%v) should == nil`, err)
+	}
+	if err := <-eh.err; err == nil {
+		t.Error(`the ContextEventHandler should have been passed the context`)
+	}
+}
+
+// TestPluginLogger tests that plugins log to the loggers of their bot.
+func TestPluginLogger(t *testing.T) {
+	b := initBot()
+	var buf bytes.Buffer
+	b.AddLogger(&DefaultLogger{AnyLogger{Output: &buf}})
+
+	l := &PluginLogger{bot: b, name: "echo"}
+	l.Warnf("said %d things", 3)
+	if !strings.Contains(buf.String(), "[plugin echo] said 3 things") {
+		t.Errorf(`buf (%q) should contain "[plugin echo] said 3 things"`, buf.String())
+	}
+}
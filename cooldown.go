@@ -0,0 +1,137 @@
+package sdbot
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scopes of the Cooldown of a Plugin, set by its CooldownScope. With
+// CooldownGlobal, using the plugin anywhere puts it on cooldown everywhere.
+// With CooldownRoom it is on cooldown in the room it was used in, with
+// CooldownUser for the user who used it, and with CooldownUserRoom for that
+// user in that room. Private messages count as a room of their own.
+const (
+	CooldownGlobal   = "global"
+	CooldownRoom     = "room"
+	CooldownUser     = "user"
+	CooldownUserRoom = "user-room"
+)
+
+// ErrUnknownCooldownScope is returned when a Plugin names a cooldown scope
+// that does not exist.
+var ErrUnknownCooldownScope = errors.New("sdbot: unknown cooldown scope (use global, room, user or user-room)")
+
+func validCooldownScope(scope string) bool {
+	switch scope {
+	case CooldownGlobal, CooldownRoom, CooldownUser, CooldownUserRoom:
+		return true
+	}
+	return false
+}
+
+// When a plugin was last used in a scope, and whether the user was told it is
+// on cooldown since.
+type cooldownEntry struct {
+	used   time.Time
+	warned bool
+}
+
+// Returns the key the plugin's cooldown of the message is kept under. The
+// user scopes fall back to the room for messages without a sender.
+func (p *Plugin) cooldownKey(m *Message) string {
+	var room, user string
+	if m.Room != nil && !m.Private() {
+		room = SanitizeRoomid(m.Room.Name)
+	}
+	if m.User != nil {
+		user = Sanitize(m.User.Name)
+	}
+
+	switch p.CooldownScope {
+	case CooldownRoom:
+		return "r:" + room
+	case CooldownUser:
+		if user != "" {
+			return "u:" + user
+		}
+		return "r:" + room
+	case CooldownUserRoom:
+		return "u:" + user + "|r:" + room
+	default:
+		return ""
+	}
+}
+
+// Returns true if the sender of the message does not have to wait for the
+// cooldown: owners of the bot, and users with at least the CooldownExempt
+// rank.
+func (p *Plugin) cooldownExempt(m *Message) bool {
+	if m.User == nil {
+		return false
+	}
+	if p.Bot.IsOwner(m.User) {
+		return true
+	}
+	if p.CooldownExempt == "" || p.CooldownExempt == BotOwner {
+		return false
+	}
+	return hasLevel(m.Auth, p.CooldownExempt)
+}
+
+// Returns true and marks the plugin as used if its Cooldown has passed since
+// it was last used in the scope of the message. Otherwise tells the user how
+// long they have to wait, once per cooldown, if the plugin or the Config has
+// a cooldown reply. Entries older than the Cooldown are swept out as the
+// plugin is used, so the bookkeeping of a busy plugin does not grow forever.
+func (p *Plugin) cooledDown(m *Message) bool {
+	if p.Cooldown <= 0 || p.cooldownExempt(m) {
+		return true
+	}
+
+	p.usedMutex.Lock()
+	if p.used == nil {
+		p.used = make(map[string]*cooldownEntry)
+	}
+	if m.Time.Sub(p.swept) >= p.Cooldown {
+		for key, e := range p.used {
+			if m.Time.Sub(e.used) >= p.Cooldown {
+				delete(p.used, key)
+			}
+		}
+		p.swept = m.Time
+	}
+
+	key := p.cooldownKey(m)
+	e := p.used[key]
+	if e == nil || m.Time.Sub(e.used) >= p.Cooldown {
+		p.used[key] = &cooldownEntry{used: m.Time}
+		p.LastUsed = m.Time
+		p.usedMutex.Unlock()
+		return true
+	}
+	left := p.Cooldown - m.Time.Sub(e.used)
+	warn := !e.warned
+	e.warned = true
+	p.usedMutex.Unlock()
+
+	if warn {
+		p.cooldownReply(m, left)
+	}
+	return false
+}
+
+// Tells the sender of the message how long until they can use the plugin
+// again, if the plugin or the Config has a cooldown reply.
+func (p *Plugin) cooldownReply(m *Message, left time.Duration) {
+	reply := p.CooldownReply
+	if reply == "" {
+		reply = p.Bot.Config.PluginCooldownReply
+	}
+	if reply == "" || m.Target == nil {
+		return
+	}
+	seconds := int((left + time.Second - 1) / time.Second)
+	m.Reply(strings.Replace(reply, "%d", strconv.Itoa(seconds), 1))
+}
@@ -0,0 +1,94 @@
+package sdbot
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCooldownScopes tests that each cooldown scope only blocks the uses of a
+// plugin in its own scope.
+func TestCooldownScopes(t *testing.T) {
+	b := initBot()
+	lobby, other := &Room{Name: "lobby"}, &Room{Name: "other"}
+	alice, bob := NewUser("Alice"), NewUser("Bob")
+	now := time.Now()
+
+	tests := []struct {
+		scope    string
+		expected []bool
+	}{
+		{CooldownGlobal, []bool{true, false, false, false}},
+		{CooldownRoom, []bool{true, false, true, false}},
+		{CooldownUser, []bool{true, true, false, false}},
+		{CooldownUserRoom, []bool{true, true, true, false}},
+	}
+	for _, test := range tests {
+		p := NewPluginWithCooldown("cd", time.Minute)
+		p.Bot = b
+		p.CooldownScope = test.scope
+
+		msgs := []*Message{
+			{User: alice, Room: lobby, Target: lobby, Time: now},
+			{User: bob, Room: lobby, Target: lobby, Time: now},
+			{User: alice, Room: other, Target: other, Time: now},
+			{User: alice, Room: lobby, Target: lobby, Time: now.Add(time.Second)},
+		}
+		for i, m := range msgs {
+			if ok := p.cooledDown(m); ok != test.expected[i] {
+				t.Errorf(`%s: p.cooledDown(msgs[%d]) (%v) should == %v`, test.scope, i, ok, test.expected[i])
+			}
+		}
+	}
+}
+
+// TestCooldownExpiry tests that a cooldown passes, that old entries are swept,
+// and that exempt ranks skip it.
+func TestCooldownExpiry(t *testing.T) {
+	b := initBot()
+	p := NewPluginWithCooldown("cd", time.Minute)
+	p.Bot = b
+	p.CooldownScope = CooldownUser
+	p.CooldownExempt = Driver
+	room := &Room{Name: "lobby"}
+	now := time.Now()
+
+	p.cooledDown(&Message{User: NewUser("Alice"), Room: room, Target: room, Time: now})
+	p.cooledDown(&Message{User: NewUser("Bob"), Room: room, Target: room, Time: now})
+	if !p.cooledDown(&Message{User: NewUser("Alice"), Room: room, Target: room, Time: now.Add(2 * time.Minute)}) {
+		t.Error(`the cooldown should have passed`)
+	}
+	if n := len(p.used); n != 1 {
+		t.Errorf(`len(p.used) (%d) should == 1`, n)
+	}
+
+	mod := &Message{User: NewUser("Mod"), Auth: Moderator, Room: room, Target: room, Time: now}
+	if !p.cooledDown(mod) || !p.cooledDown(mod) {
+		t.Error(`a moderator should not wait for the cooldown`)
+	}
+}
+
+// TestCooldownReply tests that a user is told once how long to wait, that
+// other percent signs in the reply are kept, and that unknown scopes are
+// refused at registration.
+func TestCooldownReply(t *testing.T) {
+	b := initBot()
+	p := NewPluginWithCooldown("cd", time.Minute)
+	p.Bot = b
+	p.CooldownReply = "Wait %ds, 100% sure."
+	st := &stubTarget{}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		p.cooledDown(&Message{User: NewUser("Alice"), Target: st, Time: now.Add(time.Duration(i) * 10 * time.Second)})
+	}
+	if len(st.replies) != 1 || st.replies[0] != "Wait 50s, 100% sure." {
+		t.Errorf(`st.replies (%q) should == ["Wait 50s, 100%% sure."]`, st.replies)
+	}
+
+	q := NewPlugin("bad")
+	q.CooldownScope = "galaxy"
+	if err := b.RegisterPlugin(q, "bad"); !errors.Is(err, ErrUnknownCooldownScope) {
+		t.Errorf(`err (%v) should be ErrUnknownCooldownScope`, err)
+	}
+}
@@ -0,0 +1,97 @@
+package sdbot
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// The ways a message is delivered to a plugin whose queue is full, as set by
+// the PluginOverflow field of the Config or the Overflow field of a Plugin.
+// With OverflowBlock the bot waits up to PluginBlockTimeout seconds for the
+// plugin to make room, and drops the message if it does not. With
+// OverflowDropOldest the oldest queued message makes room for the new one, and
+// with OverflowDropNewest the new message is dropped.
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+)
+
+// ErrUnknownOverflow is returned when the Config or a Plugin names an overflow
+// policy that does not exist.
+var ErrUnknownOverflow = errors.New("sdbot: unknown overflow policy (use block, drop-oldest or drop-newest)")
+
+// How many drops there are between the warnings about a slow plugin, after
+// the first one.
+const dropWarningInterval = 100
+
+func validOverflow(policy string) bool {
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+		return true
+	}
+	return false
+}
+
+// Dropped returns the number of messages that were dropped because the queue
+// of the plugin was full.
+func (p *Plugin) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Returns the overflow policy of the plugin, or that of the Config if the
+// plugin has none.
+func (p *Plugin) overflow() string {
+	if p.Overflow != "" {
+		return p.Overflow
+	}
+	return p.Bot.Config.PluginOverflow
+}
+
+// Queues a message for the plugin without ever blocking the caller for longer
+// than PluginBlockTimeout, dropping messages as the overflow policy says if
+// the queue is full.
+func (p *Plugin) deliver(ch chan *Message, m *Message) {
+	select {
+	case ch <- m:
+		return
+	default:
+	}
+
+	switch p.overflow() {
+	case OverflowDropNewest:
+		p.drop()
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-ch:
+				p.drop()
+			default:
+			}
+			select {
+			case ch <- m:
+				return
+			default:
+			}
+		}
+	default:
+		timeout := time.Duration(p.Bot.Config.PluginBlockTimeout * float64(time.Second))
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case ch <- m:
+		case <-timer.C:
+			p.drop()
+		}
+	}
+}
+
+// Counts a dropped message and warns about the slow plugin on the first drop
+// and every dropWarningInterval drops after it.
+func (p *Plugin) drop() {
+	n := atomic.AddUint64(&p.dropped, 1)
+	if n == 1 || n%dropWarningInterval == 0 {
+		Warnf("Plugin `%s` is not keeping up with its messages, %d have been dropped so far (overflow policy %s).", p.Name, n, p.overflow())
+	}
+}
@@ -0,0 +1,67 @@
+package sdbot
+
+import (
+	"testing"
+	"time"
+)
+
+// Delivers three messages to a plugin with a queue of two that nobody reads,
+// and returns what is left in the queue.
+func overflow(b *Bot, policy string) (*Plugin, []*Message) {
+	p := &Plugin{Bot: b, Name: policy, Overflow: policy}
+	ch := make(chan *Message, 2)
+
+	sent := []*Message{{Message: "1"}, {Message: "2"}, {Message: "3"}}
+	for _, m := range sent {
+		p.deliver(ch, m)
+	}
+	close(ch)
+
+	var queued []*Message
+	for m := range ch {
+		queued = append(queued, m)
+	}
+	return p, queued
+}
+
+// TestOverflowPolicies tests which messages each overflow policy keeps when a
+// plugin's queue is full, and that the dropped messages are counted.
+func TestOverflowPolicies(t *testing.T) {
+	b := initBot()
+	b.Config.PluginBlockTimeout = 0.01
+
+	tests := map[string]string{
+		OverflowBlock:      "12",
+		OverflowDropNewest: "12",
+		OverflowDropOldest: "23",
+	}
+	for policy, expected := range tests {
+		start := time.Now()
+		p, queued := overflow(b, policy)
+
+		var got string
+		for _, m := range queued {
+			got += m.Message
+		}
+		if got != expected {
+			t.Errorf(`%s should keep %s, not %s`, policy, expected, got)
+		}
+		if p.Dropped() != 1 {
+			t.Errorf(`%s: p.Dropped() (%d) should == 1`, policy, p.Dropped())
+		}
+		if policy == OverflowBlock && time.Since(start) < 10*time.Millisecond {
+			t.Errorf(`%s should wait for PluginBlockTimeout before dropping`, policy)
+		}
+	}
+}
+
+// TestRegisterPluginUnknownOverflow tests that a plugin with an unknown
+// overflow policy is refused.
+func TestRegisterPluginUnknownOverflow(t *testing.T) {
+	b := initBot()
+	p := NewPlugin("slow")
+	p.Overflow = "drop-everything"
+	if err := b.RegisterPlugin(p, "slow"); err != ErrUnknownOverflow {
+		t.Errorf(`err (%v) should == ErrUnknownOverflow`, err)
+	}
+}
@@ -8,17 +8,36 @@
 // Usage
 //
 // The Bot type represents the bot and its state. To create a Bot, call the
-// NewBot function. This currently assumes that your configuration toml file
-// is both called config.toml and is located in the same directory as your
-// bot script. Expect this to change in later versions.
+// NewBot function with the path to your configuration toml file. It returns
+// an error if the configuration could not be read.
 //
-// To connect to the server, call the bot's Connect method.
+// To connect to the server, call the bot's Connect method, which blocks until
+// the process is interrupted. Applications that want to control the lifecycle
+// of the bot themselves should call Run with a context instead, and either
+// cancel the context or call Shutdown to stop the bot gracefully.
+//
+// Errors
+//
+// Errors that stop the bot, such as failing to connect or to log in, are
+// returned by Run and Connect and wrap one of the exported Err variables so
+// they can be checked with errors.Is. Errors the bot can carry on from are
+// logged and passed to the functions registered with OnError.
 //
 // To register plugins, write your plugins under a package and import them.
 // Register them by calling the bot's RegisterPlugin and RegisterTimedPlugin
 // methods. It is recommended to register your plugins before connecting to
 // the server.
 //
+// A plugin handles its events with a HandlerFunc set with SetHandler, which
+// is passed a Context holding the message, its arguments, the plugin and a
+// logger for it, and can return an error. Plugins written against the older
+// EventHandler interface keep working, and Adapt turns an EventHandler into a
+// HandlerFunc.
+//
+// Families of commands, such as ".quote add" and ".quote del", are written as
+// a CommandGroup whose subcommands are plugins, and registered with
+// RegisterCommandGroup.
+//
 // Concurrency
 //
 // Each bot will spawn multiple goroutines for both reading and writing to the
@@ -27,12 +46,21 @@
 // goroutines looking to read the bot's state, such as the userlist, will get
 // the same result.
 //
-// A bot will spawn a separate goroutine to run every Plugin event. For this
-// reason, applications are responsible for ensuring that the plugin
+// Every Plugin has a pool of workers, PluginConcurrency of them unless it sets
+// its own Concurrency, that run its events as they come, so up to that many
+// events of a plugin run at once. The other messages wait in the plugin's
+// queue of PluginQueueLength messages, and when it is full the PluginOverflow
+// policy, or the Overflow of the plugin, decides whether the bot waits for
+// room or drops a message. A TimedPlugin still starts a goroutine for every
+// tick, unless it sets SkipIfRunning to skip the ticks that come while the
+// last event is still running.
+//
+// Applications are therefore responsible for ensuring that the plugin
 // EventHandlers are safe for concurrent use. For this reason, Bot exports a
 // Synchronize method that takes a pointer to a function and an identifying
 // string that will run all functions corresponding to that identifying string
-// on the same mutex.
+// on the same mutex. A plugin whose events must run one at a time can also set
+// its Concurrency to 1.
 //
 // Consider you want a plugin that reads and writes to a map defined in its
 // event handler. Maps cannot be read and written to concurrently, so you need
@@ -0,0 +1,141 @@
+package sdbot
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"github.com/mikopits/sdbot/protocol"
+)
+
+// AllCommands subscribes a function to every message with On.
+const AllCommands = "*"
+
+// Subscription is a function subscribed to a command with On. Pass it to Off
+// to unsubscribe.
+type Subscription struct {
+	command string
+	f       func(*Message)
+}
+
+// The long names of commands that the server also sends by their short name.
+// Both are dispatched under the short name.
+var commandAliases = map[string]string{
+	"join":  "j",
+	"leave": "l",
+	"name":  "n",
+	"chat":  "c",
+}
+
+// Returns the name a command is dispatched under. Commands are not case
+// sensitive, so "J" and "j" are the same command.
+func canonicalCommand(cmd string) string {
+	cmd = strings.ToLower(cmd)
+	if alias, ok := commandAliases[cmd]; ok {
+		return alias
+	}
+	return cmd
+}
+
+// On subscribes a function to a command of the protocol, such as "j", "popup",
+// "tournament" or a battle command like "turn", or to every message with
+// AllCommands. Long names of commands are the same as their short names, so
+// "join" is the same as "j".
+//
+// The functions of a command are called in the order they were subscribed,
+// after the bot has handled the message itself, so the UserList and RoomList
+// are already up to date. The functions subscribed to AllCommands are called
+// last. They are called from the goroutine reading the connection, so they
+// must not block; start a goroutine for anything slow. A panic in a function
+// is recovered and reported to the OnError hooks.
+func (b *Bot) On(command string, f func(*Message)) *Subscription {
+	s := &Subscription{command: canonicalCommand(command), f: f}
+
+	b.hookMutex.Lock()
+	b.subscriptions[s.command] = append(b.subscriptions[s.command], s)
+	b.hookMutex.Unlock()
+	return s
+}
+
+// Off unsubscribes a function subscribed with On. Returns false if it was
+// not subscribed.
+func (b *Bot) Off(s *Subscription) bool {
+	b.hookMutex.Lock()
+	defer b.hookMutex.Unlock()
+
+	subs := b.subscriptions[s.command]
+	for i, sub := range subs {
+		if sub == s {
+			b.subscriptions[s.command] = append(subs[:i:i], subs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// OnJoin subscribes a function to users joining the rooms the bot is in.
+func (b *Bot) OnJoin(f func(*Message, *protocol.Join)) *Subscription {
+	return b.On("j", func(m *Message) {
+		if p, ok := m.Parsed.(*protocol.Join); ok {
+			f(m, p)
+		}
+	})
+}
+
+// OnLeave subscribes a function to users leaving the rooms the bot is in.
+func (b *Bot) OnLeave(f func(*Message, *protocol.Leave)) *Subscription {
+	return b.On("l", func(m *Message) {
+		if p, ok := m.Parsed.(*protocol.Leave); ok {
+			f(m, p)
+		}
+	})
+}
+
+// OnRename subscribes a function to users changing their name in the rooms
+// the bot is in.
+func (b *Bot) OnRename(f func(*Message, *protocol.Name)) *Subscription {
+	return b.On("n", func(m *Message) {
+		if p, ok := m.Parsed.(*protocol.Name); ok {
+			f(m, p)
+		}
+	})
+}
+
+// OnPopup subscribes a function to the popups the server shows the bot.
+func (b *Bot) OnPopup(f func(*Message, *protocol.Popup)) *Subscription {
+	return b.On("popup", func(m *Message) {
+		if p, ok := m.Parsed.(*protocol.Popup); ok {
+			f(m, p)
+		}
+	})
+}
+
+// Calls the bot's own handler of a command, then the functions subscribed to
+// it, then the functions subscribed to every command.
+func (b *Bot) dispatch(command string, m *Message) {
+	command = canonicalCommand(command)
+	if h := b.handlers[command]; h != nil {
+		h(m)
+	}
+
+	b.hookMutex.Lock()
+	subs := append([]*Subscription{}, b.subscriptions[command]...)
+	subs = append(subs, b.subscriptions[AllCommands]...)
+	b.hookMutex.Unlock()
+
+	for _, s := range subs {
+		b.call(s, m)
+	}
+}
+
+// Calls a subscribed function, recovering from a panic so that a faulty
+// function cannot take down the goroutine reading the connection. The panic
+// is reported to the OnError hooks.
+func (b *Bot) call(s *Subscription, m *Message) {
+	defer func() {
+		if v := recover(); v != nil {
+			b.reportError(fmt.Errorf("sdbot: function subscribed to %q panicked handling %q: %v\n%s", s.command, m.Message, v, debug.Stack()))
+		}
+	}()
+	s.f(m)
+}
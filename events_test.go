@@ -0,0 +1,80 @@
+package sdbot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mikopits/sdbot/protocol"
+)
+
+// TestOnOrder tests that subscribers are called in the order they subscribed,
+// after the bot has handled the message and before the subscribers of every
+// command, and that long and upper case commands reach them.
+func TestOnOrder(t *testing.T) {
+	b := initBot()
+	var calls []string
+
+	b.On(AllCommands, func(m *Message) { calls = append(calls, "all") })
+	b.On("j", func(m *Message) {
+		if b.RoomList["testroom"] == nil || len(b.RoomList["testroom"].Users) != 1 {
+			t.Error(`the bot should have handled the join first`)
+		}
+		calls = append(calls, "first")
+	})
+	b.On("join", func(m *Message) { calls = append(calls, "second") })
+
+	b.Connection.parse(">testroom\n|J|+Tympy", false)
+
+	expected := []string{"first", "second", "all"}
+	if len(calls) != len(expected) {
+		t.Fatalf(`calls (%v) should == %v`, calls, expected)
+	}
+	for i, e := range expected {
+		if calls[i] != e {
+			t.Errorf(`calls[%d] (%s) should == %s`, i, calls[i], e)
+		}
+	}
+}
+
+// TestOff tests that a function is no longer called once it unsubscribed.
+func TestOff(t *testing.T) {
+	b := initBot()
+	var joins []string
+
+	s := b.OnJoin(func(m *Message, j *protocol.Join) {
+		joins = append(joins, j.User.Name)
+	})
+	b.Connection.parse(">testroom\n|j|+Tympy", false)
+
+	if !b.Off(s) {
+		t.Error(`b.Off(s) should be true`)
+	}
+	if b.Off(s) {
+		t.Error(`b.Off(s) should be false once unsubscribed`)
+	}
+	b.Connection.parse(">testroom\n|j|+Mystifi", false)
+
+	if len(joins) != 1 || joins[0] != "Tympy" {
+		t.Errorf(`joins (%v) should == [Tympy]`, joins)
+	}
+}
+
+// TestOnPanic tests that a panicking subscriber is reported and does not stop
+// the subscribers after it.
+func TestOnPanic(t *testing.T) {
+	b := initBot()
+	var errs []error
+	b.OnError(func(err error) { errs = append(errs, err) })
+
+	var called bool
+	b.On("j", func(m *Message) { panic("oops") })
+	b.On("j", func(m *Message) { called = true })
+	b.Connection.parse(">testroom\n|j|+Tympy", false)
+
+	if !called {
+		t.Error(`the second subscriber should have been called`)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "oops") {
+		t.Errorf(`errs (%v) should hold the panic`, errs)
+	}
+}
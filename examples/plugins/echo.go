@@ -10,12 +10,9 @@ import (
 // Repeat what was said after the echo command.
 var EchoPlugin = func() *sdbot.Plugin {
 	p := sdbot.NewPluginWithArgs("echo", 1)
-	p.SetEventHandler(&EchoEventHandler{Plugin: p})
+	p.SetHandler(func(c *sdbot.Context) error {
+		c.Reply(c.Arg(0))
+		return nil
+	})
 	return p
 }
-
-type EchoEventHandler sdbot.DefaultEventHandler
-
-func (eh *EchoEventHandler) HandleEvent(m *sdbot.Message, args []string) {
-	m.Reply(args[0])
-}
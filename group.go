@@ -0,0 +1,215 @@
+package sdbot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidSubcommand is returned when a CommandGroup has a subcommand that
+// is not a plain word, is named "help", or shares its name with another one.
+var ErrInvalidSubcommand = errors.New("sdbot: invalid subcommand (use a unique word other than help)")
+
+// CommandGroup is a family of commands under a root command, such as
+// ".quote add", ".quote del" and ".quote random". Each subcommand is a Plugin
+// with its own Args, auth requirement and cooldown, whose Command is its name
+// in the group. Groups can be nested with Group, as in ".quote tag add".
+//
+// Registering the group with Bot.RegisterCommandGroup also registers its
+// root command, which sends the help tree of the group in private message for
+// the root command alone, for "help", and for subcommands that do not exist.
+// The help tree lists the usage and Description of every subcommand the user
+// may use.
+type CommandGroup struct {
+	Name        string
+	Description string
+	parent      *CommandGroup
+	plugins     []*Plugin
+	groups      []*CommandGroup
+	root        *Plugin
+}
+
+// NewCommandGroup creates a CommandGroup under the root command name.
+func NewCommandGroup(name string, description string) *CommandGroup {
+	return &CommandGroup{Name: name, Description: description}
+}
+
+// Add adds subcommands to the group. Their Command is their name in the
+// group, so NewPlugin("add") adds ".quote add" to the group "quote", and is
+// set to their full command as they are added.
+func (g *CommandGroup) Add(plugins ...*Plugin) {
+	command := g.command()
+	for _, p := range plugins {
+		p.Command = command + " " + p.Command
+	}
+	g.plugins = append(g.plugins, plugins...)
+}
+
+// Returns the name of a subcommand in the group, such as "add" for
+// "quote add".
+func (g *CommandGroup) subName(p *Plugin) string {
+	return strings.TrimPrefix(p.Command, g.command()+" ")
+}
+
+// Group adds a nested group of subcommands to the group and returns it.
+func (g *CommandGroup) Group(name string, description string) *CommandGroup {
+	sub := &CommandGroup{Name: name, Description: description, parent: g}
+	g.groups = append(g.groups, sub)
+	return sub
+}
+
+// Returns the command of the group, such as "quote tag".
+func (g *CommandGroup) command() string {
+	if g.parent == nil {
+		return g.Name
+	}
+	return g.parent.command() + " " + g.Name
+}
+
+// Returns an error if a name in the group is not a unique plain word.
+func (g *CommandGroup) validate() error {
+	if g.parent == nil && (!commandNameRegexp.MatchString(g.Name) || strings.ContainsAny(g.Name, "/!")) {
+		return fmt.Errorf("%w: %q", ErrInvalidSubcommand, g.Name)
+	}
+
+	seen := map[string]bool{"help": true}
+	names := make([]string, 0, len(g.plugins)+len(g.groups))
+	for _, p := range g.plugins {
+		names = append(names, g.subName(p))
+	}
+	for _, sub := range g.groups {
+		names = append(names, sub.Name)
+	}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if !commandNameRegexp.MatchString(name) || strings.ContainsAny(name, "/!") || seen[key] {
+			return fmt.Errorf("%w: %q in group %q", ErrInvalidSubcommand, name, g.command())
+		}
+		seen[key] = true
+	}
+	for _, sub := range g.groups {
+		if err := sub.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the group has a subcommand or nested group of that name.
+func (g *CommandGroup) has(name string) bool {
+	for _, p := range g.plugins {
+		if strings.EqualFold(g.subName(p), name) {
+			return true
+		}
+	}
+	for _, sub := range g.groups {
+		if strings.EqualFold(sub.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Help returns the help tree of the group for the sender of the message: a
+// line for the group, then the usage of every subcommand they may use, with
+// the nested groups after the subcommands. Commands are shown without a
+// prefix until the group is registered.
+func (g *CommandGroup) Help(m *Message) string {
+	var lines []string
+	g.help(m, &lines)
+	return strings.Join(lines, "\n")
+}
+
+func (g *CommandGroup) help(m *Message, lines *[]string) {
+	var b *Bot
+	if g.root != nil {
+		b = g.root.Bot
+	}
+	line := b.usagePrefix() + g.command() + " help"
+	if g.Description != "" {
+		line += " - " + g.Description
+	}
+	*lines = append(*lines, line)
+
+	for _, p := range g.plugins {
+		if p.Bot != nil && p.authorized(m) != accessAllowed {
+			continue
+		}
+		line := p.Usage()
+		if p.Description != "" {
+			line += " - " + p.Description
+		}
+		*lines = append(*lines, line)
+	}
+	for _, sub := range g.groups {
+		sub.help(m, lines)
+	}
+}
+
+// Handles the root command of a group: sends the help tree for the root
+// command alone and for "help", and for subcommands that do not exist.
+func (g *CommandGroup) handleRoot(c *Context) error {
+	sub := c.Values.String("subcommand")
+	if i := strings.IndexByte(sub, ' '); i >= 0 {
+		sub = sub[:i]
+	}
+	switch {
+	case sub == "" || strings.EqualFold(sub, "help"):
+		g.sendHelp(c.Message, g.Help(c.Message))
+	case !g.has(sub):
+		g.sendHelp(c.Message, fmt.Sprintf("%s is not a subcommand of %s.\n%s", sub, g.command(), g.Help(c.Message)))
+	}
+	return nil
+}
+
+// Sends the help to the user in private message, every line in full, since a
+// reply would be cut to MaxReplyChunks messages and lose most of the tree.
+func (g *CommandGroup) sendHelp(m *Message, help string) {
+	if m.User == nil {
+		m.Reply(help)
+		return
+	}
+	m.User.replyAll(m, help)
+}
+
+// Returns the plugins of the group and of its nested groups, along with their
+// root commands.
+func (g *CommandGroup) build() []*Plugin {
+	if g.root == nil {
+		g.root = NewPlugin(g.command())
+		g.root.Args = []Arg{{Name: "subcommand", Optional: true}}
+		g.root.SetHandler(g.handleRoot)
+		g.root.group = g
+	}
+
+	plugins := append([]*Plugin{g.root}, g.plugins...)
+	for _, sub := range g.groups {
+		plugins = append(plugins, sub.build()...)
+	}
+	return plugins
+}
+
+// RegisterCommandGroup registers the subcommands of a group and its root
+// command as plugins, named after their full command, such as "quote add".
+// It can be called again to register the subcommands added since.
+func (b *Bot) RegisterCommandGroup(g *CommandGroup) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	for _, p := range g.build() {
+		if err := b.RegisterPlugin(p, p.Command); err != nil && err != ErrPluginAlreadyRegistered {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnregisterCommandGroup unregisters the subcommands of a group and its root
+// command. Returns true if they were all registered.
+func (b *Bot) UnregisterCommandGroup(g *CommandGroup) bool {
+	ok := true
+	for _, p := range g.build() {
+		ok = b.UnregisterPlugin(p) && ok
+	}
+	return ok
+}
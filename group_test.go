@@ -0,0 +1,180 @@
+package sdbot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds the quote group of the tests: ".quote add <text>", ".quote del <id>"
+// for moderators, and ".quote tag add <tag>".
+func quoteGroup() (*CommandGroup, *Plugin, *Plugin, *Plugin) {
+	g := NewCommandGroup("quote", "Manages quotes.")
+	add := NewPlugin("add")
+	add.Description = "Adds a quote."
+	add.Args = []Arg{{Name: "text"}}
+	del := NewPlugin("del")
+	del.Args = []Arg{{Name: "id", Type: ArgInt}}
+	del.RequireAuth(Moderator)
+	g.Add(add, del)
+
+	tagAdd := NewPlugin("add")
+	tagAdd.Args = []Arg{{Name: "tag"}}
+	g.Group("tag", "").Add(tagAdd)
+	return g, add, del, tagAdd
+}
+
+// TestCommandGroupRoute tests that the subcommands of a group are routed to,
+// each with their own arguments, and that the root command catches the rest.
+func TestCommandGroupRoute(t *testing.T) {
+	b := initBot()
+	g, add, del, tagAdd := quoteGroup()
+	if err := b.RegisterCommandGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterCommandGroup(g)
+
+	if add.Command != "quote add" || tagAdd.Command != "quote tag add" {
+		t.Errorf(`add.Command, tagAdd.Command (%s, %s) should == "quote add", "quote tag add"`, add.Command, tagAdd.Command)
+	}
+
+	tests := map[string][]*Plugin{
+		".quote add hello, world": {add},
+		".quote del 3":            {del},
+		".quote tag add funny":    {tagAdd},
+		".quote tag":              {g.groups[0].root},
+		".quote":                  {g.root},
+		".quote nope":             {g.root},
+		".quotes":                 nil,
+	}
+	for msg, expected := range tests {
+		matched := b.router.route(NewMessage(">testroom\n|c:|1|+Mystifi|"+msg, b))
+		if len(matched) != len(expected) {
+			t.Errorf(`%q matched %d plugins, should match %d`, msg, len(matched), len(expected))
+			continue
+		}
+		for i := range matched {
+			if matched[i] != expected[i] {
+				t.Errorf(`%q matched %s, should match %s`, msg, matched[i].Name, expected[i].Name)
+			}
+		}
+	}
+}
+
+// TestCommandGroupHelp tests that the help tree only lists the subcommands
+// the user may use, and that the root command sends it in private message.
+func TestCommandGroupHelp(t *testing.T) {
+	b := initBot()
+	g, _, _, _ := quoteGroup()
+	if err := b.RegisterCommandGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterCommandGroup(g)
+
+	room := &Room{Name: "testroom"}
+	voice := &Message{Bot: b, User: NewUser("Voice"), Auth: Voiced, Room: room, Target: room}
+	expected := ".quote help - Manages quotes.\n.quote add <text> - Adds a quote.\n.quote tag help\n.quote tag add <tag>"
+	if help := g.Help(voice); help != expected {
+		t.Errorf(`g.Help(voice) (%q) should == %q`, help, expected)
+	}
+	mod := &Message{Bot: b, User: NewUser("Mod"), Auth: Moderator, Room: room, Target: room}
+	if help := g.Help(mod); help == expected {
+		t.Error(`g.Help(mod) should list .quote del`)
+	}
+
+	st := &stubTarget{}
+	for sub, lines := range map[string]int{"": 4, "help": 4, "nope": 5, "add": 0, "tag add x": 0} {
+		c := &Context{Message: &Message{Bot: b, User: NewUser("Voice"), Target: st}, Values: ArgValues{"subcommand": sub}}
+		g.handleRoot(c)
+		if msgs := queued(b); len(msgs) != lines {
+			t.Errorf(`the root command sent %d messages for %q, should send %d`, len(msgs), sub, lines)
+		}
+	}
+	if len(st.replies) != 0 {
+		t.Errorf(`the root command replied %d times in the room, should send the help privately`, len(st.replies))
+	}
+}
+
+// TestCommandGroupHelpFull tests that the help tree is sent in full under the
+// default Config, which splits replies into MaxReplyChunks messages at most.
+func TestCommandGroupHelpFull(t *testing.T) {
+	b := initBot()
+	g, _, _, _ := quoteGroup()
+	for _, name := range []string{"random", "list", "search", "edit"} {
+		g.Add(NewPlugin(name))
+	}
+	if err := b.RegisterCommandGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterCommandGroup(g)
+
+	m := &Message{Bot: b, User: NewUser("Mod"), Auth: Moderator, Target: &Room{Name: "testroom"}}
+	g.handleRoot(&Context{Message: m, Values: ArgValues{}})
+
+	help := strings.Split(g.Help(m), "\n")
+	msgs := queued(b)
+	if len(help) <= b.Config.MaxReplyChunks || len(msgs) != len(help) {
+		t.Fatalf(`the root command sent %d messages, should send the %d lines of the help`, len(msgs), len(help))
+	}
+	for i, line := range help {
+		if expected := "|/w Mod," + line; msgs[i] != expected {
+			t.Errorf(`msgs[%d] (%q) should == %q`, i, msgs[i], expected)
+		}
+	}
+}
+
+// Takes the messages queued by the bot, in the order they would be sent.
+func queued(b *Bot) []string {
+	var msgs []string
+	rl := unlimited()
+	for om, _ := b.Connection.outbox.pop(rl, time.Now()); om != nil; om, _ = b.Connection.outbox.pop(rl, time.Now()) {
+		msgs = append(msgs, om.Text)
+	}
+	return msgs
+}
+
+// TestCommandGroupLate tests that the help tree can be built before the group
+// is registered, and that subcommands added after it are registered with
+// their full command.
+func TestCommandGroupLate(t *testing.T) {
+	b := initBot()
+	g, _, _, _ := quoteGroup()
+	expected := "quote help - Manages quotes.\nquote add <text> - Adds a quote.\nquote del <id:int>\nquote tag help\nquote tag add <tag>"
+	if help := g.Help(&Message{Bot: b}); help != expected {
+		t.Errorf(`g.Help before registration (%q) should == %q`, help, expected)
+	}
+
+	if err := b.RegisterCommandGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterCommandGroup(g)
+
+	random := NewPlugin("random")
+	g.Add(random)
+	if err := b.RegisterCommandGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if random.Command != "quote random" {
+		t.Errorf(`random.Command (%s) should == "quote random"`, random.Command)
+	}
+	matched := b.router.route(NewMessage(">testroom\n|c:|1|+Mystifi|.quote random", b))
+	if len(matched) != 1 || matched[0] != random {
+		t.Errorf(`.quote random matched %d plugins, should match random only`, len(matched))
+	}
+}
+
+// TestCommandGroupInvalid tests that invalid and duplicate subcommands are
+// refused.
+func TestCommandGroupInvalid(t *testing.T) {
+	b := initBot()
+	for _, names := range [][]string{{"help"}, {"add", "ADD"}, {"two words"}} {
+		g := NewCommandGroup("quote", "")
+		for _, name := range names {
+			g.Add(NewPlugin(name))
+		}
+		if err := b.RegisterCommandGroup(g); !errors.Is(err, ErrInvalidSubcommand) {
+			t.Errorf(`err (%v) should be ErrInvalidSubcommand for %q`, err, names)
+		}
+	}
+}
@@ -2,74 +2,87 @@ package sdbot
 
 import (
 	"encoding/json"
-	"errors"
-	"reflect"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
-)
 
-// Define function handlers to call depending on the command we get.
-var handlers = map[string]interface{}{
-	"challstr":      onChallstr,
-	"updateuser":    onUpdateuser,
-	"l":             onLeave,
-	"j":             onJoin,
-	"n":             onNick,
-	"init":          onInit,
-	"deinit":        onDeinit,
-	"users":         onUsers,
-	"popup":         onPopup,
-	"c:":            onChat,
-	"pm":            onPrivateMessage,
-	"tournament":    onTournament,
-	"formats":       onFormats,
-	"queryresponse": onQueryResponse,
-	"win":           onWin,
-}
-
-// callHandler uses reflection to call a handler if it exists for the given command
-func callHandler(m map[string]interface{}, name string, params ...interface{}) (result []reflect.Value, err error) {
-	f := reflect.ValueOf(m[name])
-	if !f.IsValid() {
-		return
-	}
+	"github.com/mikopits/sdbot/protocol"
+)
 
-	if len(params) != f.Type().NumIn() {
-		err = errors.New("The number of params is not adapted.")
-		return
-	}
-	in := make([]reflect.Value, len(params))
-	for k, param := range params {
-		in[k] = reflect.ValueOf(param)
+// Define function handlers to call depending on the command we get. Every Bot
+// gets its own copy of the handlers. Commands are dispatched under their short
+// names, see canonicalCommand.
+func newHandlers() map[string]func(*Message) {
+	return map[string]func(*Message){
+		"challstr":      onChallstr,
+		"updateuser":    onUpdateuser,
+		"nametaken":     onNametaken,
+		"l":             onLeave,
+		"j":             onJoin,
+		"n":             onNick,
+		"init":          onInit,
+		"deinit":        onDeinit,
+		"title":         onTitle,
+		"users":         onUsers,
+		"popup":         onPopup,
+		"c:":            onChat,
+		"c":             onChat,
+		"raw":           onHTML,
+		"html":          onHTML,
+		"uhtml":         onHTML,
+		"uhtmlchange":   onHTML,
+		"pm":            onPrivateMessage,
+		"tournament":    onTournament,
+		"formats":       onFormats,
+		"queryresponse": onQueryResponse,
+		"win":           onWin,
 	}
-	result = f.Call(in)
-	return
 }
 
 func onChallstr(m *Message) {
 	Info("Attempting to log in...")
-	m.Bot.login(m)
+	err := m.Bot.login(m)
+	if err != nil {
+		m.Bot.Connection.fail(err)
+	}
 }
 
-var once sync.Once
+func onNametaken(m *Message) {
+	nt, ok := m.Parsed.(*protocol.NameTaken)
+	if !ok {
+		return
+	}
+	m.Bot.Connection.fail(&LoginError{Err: ErrNameTaken, Message: nt.Message})
+}
 
 func onUpdateuser(m *Message) {
-	switch m.Params[1] {
-	case "0":
+	uu, ok := m.Parsed.(*protocol.UpdateUser)
+	if !ok {
+		return
+	}
+	if !uu.Named {
 		if m.Bot.Config.Avatar > 0 && m.Bot.Config.Avatar <= 294 {
 			m.Bot.Connection.QueueMessage("|/avatar " + strconv.Itoa(m.Bot.Config.Avatar))
 		}
-	case "1":
-		for _, r := range m.Bot.Config.Rooms {
-			room := FindRoomEnsured(r, m.Bot)
-			m.Bot.JoinRoom(room)
-		}
-		// We have successfully logged in, start TimedPlugins.
-		once.Do(func() { m.Bot.StartTimedPlugins() })
+		return
+	}
+
+	// Restore the previous session if we are logging back in after the
+	// connection dropped.
+	if attempts := m.Bot.Connection.restoreAttempts; attempts > 0 {
+		m.Bot.Connection.restoreAttempts = 0
+		m.Bot.restoreSession(attempts)
+		return
+	}
+
+	for _, r := range m.Bot.Config.Rooms {
+		room := FindRoomEnsured(r, m.Bot)
+		m.Bot.JoinRoom(room)
 	}
+	// We have successfully logged in, start TimedPlugins.
+	m.Bot.timedPluginsOnce.Do(func() { m.Bot.StartTimedPlugins() })
 }
 
 func onLeave(msg *Message) {
@@ -78,16 +91,16 @@ func onLeave(msg *Message) {
 }
 
 func onJoin(msg *Message) {
-	if msg.User.Name == msg.Bot.Nick {
-		onInit(msg)
-	}
-
 	FindUserEnsured(msg.User.Name, msg.Bot).AddAuth(msg.Room.Name, msg.Auth)
 	FindRoomEnsured(msg.Room.Name, msg.Bot).AddUser(msg.User.Name)
 }
 
 func onNick(m *Message) {
-	oldNick := m.Params[1]
+	name, ok := m.Parsed.(*protocol.Name)
+	if !ok {
+		return
+	}
+	oldNick := name.OldID
 	Rename(oldNick, m.User.Name, m.Room, m.Bot, m.Auth)
 	if Sanitize(oldNick) == Sanitize(m.Bot.Nick) {
 		m.Bot.Nick = m.User.Name
@@ -95,6 +108,10 @@ func onNick(m *Message) {
 }
 
 func onInit(m *Message) {
+	// The users of the room follow in the same frame, so forget the users of
+	// any previous visit.
+	FindRoomEnsured(m.Room.Name, m.Bot).Users = nil
+
 	// This may occur if the bot is redirected. Leave the room if it
 	// is not a room it should be in, and try to rejoin any rooms that
 	// it should be in.
@@ -125,25 +142,38 @@ func onDeinit(m *Message) {
 	// TODO Attempt to rejoin? Does the state need to be updated?
 }
 
+func onTitle(m *Message) {
+	if title, ok := m.Parsed.(*protocol.Title); ok {
+		FindRoomEnsured(m.Room.Name, m.Bot).Title = title.Title
+	}
+}
+
 func onUsers(m *Message) {
+	users, ok := m.Parsed.(*protocol.Users)
+	if !ok {
+		return
+	}
 	// Populate the room with its users and their auth levels.
-	for _, user := range strings.Split(m.Params[0], ",")[1:] {
-		auth, nick := string(user[0]), user[1:]
-		FindRoomEnsured(m.Room.Name, m.Bot).AddUser(nick)
-		FindUserEnsured(nick, m.Bot).AddAuth(m.Room.Name, auth)
+	for _, user := range users.Users {
+		FindRoomEnsured(m.Room.Name, m.Bot).AddUser(user.Name)
+		FindUserEnsured(user.Name, m.Bot).AddAuth(m.Room.Name, user.Rank)
 	}
 }
 
 func onPopup(m *Message) {
-	if len(m.Params) < 3 {
+	p, ok := m.Parsed.(*protocol.Popup)
+	if !ok {
 		return
 	}
+	popup := p.Message
 
 	// Handle bans
-	if strings.Contains(m.Params[2], "has banned you from the room") {
-		reg, err := regexp.Compile("<p>(?P<user>[^ ]+) has banned you from the room (?P<room>[^ ]*).</p><p>To appeal")
-		CheckErr(err)
-		match := reg.FindStringSubmatch(m.Params[2])
+	if strings.Contains(popup, "has banned you from the room") {
+		reg := regexp.MustCompile("<p>(?P<user>[^ ]+) has banned you from the room (?P<room>[^ ]*).</p><p>To appeal")
+		match := reg.FindStringSubmatch(popup)
+		if match == nil {
+			return
+		}
 		result := make(map[string]string)
 		for i, name := range reg.SubexpNames() {
 			if i != 0 {
@@ -161,20 +191,59 @@ func onPopup(m *Message) {
 	}
 }
 
+// Chat, HTML and private messages are only passed to the plugins they match,
+// as found by the router.
 func onChat(m *Message) {
-	if m.Bot.Connection.LoginTime[m.Room.Name] == 0 {
+	if m.Message == "" || m.Bot.Config.IgnoreChatMessages {
 		return
 	}
-	if m.Message != "" && m.Timestamp >= m.Bot.Connection.LoginTime[m.Room.Name] {
-		for name := range m.Bot.PluginChatChannels {
-			m.Bot.pluginChatChannelsWrite(name, m)
-		}
-	}
+	routeToPlugins(m, m.Bot.pluginChatChannelsWrite)
+}
+
+// Plugins only receive HTML if they ask for KindHTML.
+func onHTML(m *Message) {
+	onChat(m)
 }
 
 func onPrivateMessage(m *Message) {
-	for name := range m.Bot.PluginPrivateChannels {
-		m.Bot.pluginPrivateChannelsWrite(name, m)
+	if m.Bot.Config.IgnorePrivateMessages {
+		return
+	}
+	routeToPlugins(m, m.Bot.pluginPrivateChannelsWrite)
+}
+
+// Passes a message to the plugins it is meant for with write, unless the
+// sender may not use them, got their arguments wrong, or the plugins are on
+// cooldown. The arguments parsed for each plugin are kept in the message, and
+// all of them are parsed before the message reaches any plugin.
+func routeToPlugins(m *Message, write func(*Plugin, *Message)) {
+	var plugins []*Plugin
+	for _, p := range m.Bot.router.route(m) {
+		switch p.authorized(m) {
+		case accessDenied:
+			p.deny(m)
+			continue
+		case accessIgnored:
+			continue
+		}
+		values, given, err := p.parseArgs(m)
+		if err != nil {
+			p.usage(m, err)
+			continue
+		}
+		if !p.cooledDown(m) {
+			continue
+		}
+		if len(p.Args) > 0 {
+			if m.args == nil {
+				m.args = make(map[*Plugin]parsedArgs)
+			}
+			m.args[p] = parsedArgs{values: values, given: given}
+		}
+		plugins = append(plugins, p)
+	}
+	for _, p := range plugins {
+		write(p, m)
 	}
 }
 
@@ -182,17 +251,16 @@ func onTournament(m *Message) {
 	// TODO
 }
 
-// Parse and store the current battle formats in Bot.BattleFormats
+// Store the current battle formats in Bot.BattleFormats
 func onFormats(m *Message) {
-	formatsStr := "|" + strings.Join(m.Params, "|")
-	formatsStr = regexp.MustCompile("[,#]").ReplaceAllString(formatsStr, "")
-	formatsStr = regexp.MustCompile("\\|[0-9]+\\|[^|]+").ReplaceAllString(formatsStr, "")
+	f, ok := m.Parsed.(*protocol.Formats)
+	if !ok {
+		return
+	}
 	var formats []string
-	var sanitized string
-	for _, format := range strings.Split(formatsStr, "|") {
-		sanitized = Sanitize(format)
-		if len(sanitized) > 0 {
-			formats = append(formats, sanitized[:len(sanitized)-1])
+	for _, format := range f.Formats {
+		if sanitized := Sanitize(format.Name); len(sanitized) > 0 {
+			formats = append(formats, sanitized)
 		}
 	}
 	m.Bot.BattleFormats = formats
@@ -212,10 +280,13 @@ type BattleInfo struct {
 
 func onQueryResponse(m *Message) {
 	// Populate the bot with "roomlist" information.
-	if m.Params[0] == "roomlist" {
+	if qr, ok := m.Parsed.(*protocol.QueryResponse); ok && qr.Query == "roomlist" {
 		var recentBattles RecentBattles
-		err := json.Unmarshal([]byte(m.Params[1]), &recentBattles)
-		CheckErr(err)
+		err := json.Unmarshal([]byte(qr.JSON), &recentBattles)
+		if err != nil {
+			m.Bot.reportError(fmt.Errorf("sdbot: could not decode roomlist: %w", err))
+			return
+		}
 		m.Bot.RecentBattles <- &recentBattles
 	}
 }
@@ -3,6 +3,7 @@ package sdbot
 import (
 	"bytes"
 	"encoding/json"
+	"html"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -28,6 +29,19 @@ func SanitizeRoomid(s string) string {
 	return strings.ToLower(reg.ReplaceAllString(s, ""))
 }
 
+var htmlBreakRegexp = regexp.MustCompile(`(?i)<(br|hr|/?p|/?div|/?li|/?tr)\b[^>]*>`)
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// StripHTML returns the text of an HTML string, without its tags and with its
+// entities decoded. Line breaks and runs of whitespace become single spaces.
+// It is meant for matching HTML messages, not for showing them.
+func StripHTML(s string) string {
+	s = htmlBreakRegexp.ReplaceAllString(s, " ")
+	s = htmlTagRegexp.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
 // Public API for access to the LoggerList loggers.
 
 // CheckErr checks if an error is nil, and if it is not, logs the error to
@@ -39,68 +53,85 @@ func CheckErr(err error) {
 }
 
 // CheckErrAll checks if an error is nil, and if it is not, logs the error to
-// all the loggers in the LoggerList. TODO Perhaps a nice stack trace here as
-// well.
+// all the loggers in the default LoggerList.
+//
+// Deprecated: Use Bot.CheckErrAll.
 func CheckErrAll(err error) {
 	if err != nil {
 		ErrorAll(err)
 	}
 }
 
+// CheckErrAll checks if an error is nil, and if it is not, logs the error to
+// all the loggers in the bot's LoggerList. TODO Perhaps a nice stack trace
+// here as well.
+func (b *Bot) CheckErrAll(err error) {
+	if err != nil {
+		b.ErrorAll(err)
+	}
+}
+
 // Debug logs debug messages to the default os.Stderr logger.
 func Debug(s string) {
-	logDebug(&loggers.Loggers[0], s)
+	logDebug(&defaultLogger, s)
 }
 
 // Info logs informatic messages to the default os.Stderr logger.
 func Info(s string) {
-	logInfo(&loggers.Loggers[0], s)
+	logInfo(&defaultLogger, s)
 }
 
 // Warn logs warning messages to the default os.Stderr logger.
 func Warn(s string) {
-	logWarn(&loggers.Loggers[0], s)
+	logWarn(&defaultLogger, s)
 }
 
 // Error logs errors to the default os.Stderr logger.
 func Error(err error) {
-	logError(&loggers.Loggers[0], err)
+	logError(&defaultLogger, err)
 }
 
 // Fatal logs fatal messages to the default os.Stderr logger.
 func Fatal(s string) {
-	logFatal(&loggers.Loggers[0], s)
+	logFatal(&defaultLogger, s)
 }
 
 // Debugf logs debug messages with formatting to the default os.Stderr logger.
 func Debugf(format string, a ...interface{}) {
-	logDebugf(&loggers.Loggers[0], format, a...)
+	logDebugf(&defaultLogger, format, a...)
 }
 
 // Infof logs informatic messages with formatting to the default os.Stderr
 // logger.
 func Infof(format string, a ...interface{}) {
-	logInfof(&loggers.Loggers[0], format, a...)
+	logInfof(&defaultLogger, format, a...)
 }
 
 // Warnf logs warning messages with formatting to the default os.Stderr logger.
 func Warnf(format string, a ...interface{}) {
-	logWarnf(&loggers.Loggers[0], format, a...)
+	logWarnf(&defaultLogger, format, a...)
 }
 
 // Errorf logs errors with formatting to the default os.Stderr logger.
 func Errorf(format string, a ...interface{}) {
-	logErrorf(&loggers.Loggers[0], format, a...)
+	logErrorf(&defaultLogger, format, a...)
 }
 
 // Fatalf logs fatal messages with formatting to the default os.Stderr logger.
 func Fatalf(format string, a ...interface{}) {
-	logFatalf(&loggers.Loggers[0], format, a...)
+	logFatalf(&defaultLogger, format, a...)
 }
 
-// ErrorAll logs errors to all the loggers in the LoggerList.
+// ErrorAll logs errors to all the loggers in the default LoggerList.
+//
+// Deprecated: Use Bot.ErrorAll.
 func ErrorAll(err error) {
-	logErrorAll(loggers, err)
+	logErrorAll(defaultLoggers, err)
+}
+
+// ErrorAll logs errors to all the loggers in the bot's LoggerList.
+func (b *Bot) ErrorAll(err error) {
+	logErrorAll(b.Loggers, err)
 }
 
 // Inspect logs a debug message to the default os.Stderr logger, taking
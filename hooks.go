@@ -0,0 +1,63 @@
+package sdbot
+
+// OnError registers a function that is called with every error the bot runs
+// into while it is running, such as failing to send a message or to decode a
+// server response. Errors that stop the bot are returned by Run instead.
+func (b *Bot) OnError(f func(error)) {
+	b.hookMutex.Lock()
+	b.errorHooks = append(b.errorHooks, f)
+	b.hookMutex.Unlock()
+}
+
+// OnDisconnect registers a function that is called with the error that caused
+// the connection to drop, before any reconnect attempt is made.
+func (b *Bot) OnDisconnect(f func(error)) {
+	b.hookMutex.Lock()
+	b.disconnectHooks = append(b.disconnectHooks, f)
+	b.hookMutex.Unlock()
+}
+
+// OnReconnect registers a function that is called once the bot has logged back
+// in after a dropped connection. It is passed the number of attempts it took.
+func (b *Bot) OnReconnect(f func(int)) {
+	b.hookMutex.Lock()
+	b.reconnectHooks = append(b.reconnectHooks, f)
+	b.hookMutex.Unlock()
+}
+
+func (b *Bot) disconnected(err error) {
+	b.hookMutex.Lock()
+	hooks := append([]func(error){}, b.disconnectHooks...)
+	b.hookMutex.Unlock()
+
+	for _, f := range hooks {
+		f(err)
+	}
+}
+
+func (b *Bot) reconnected(attempts int) {
+	b.hookMutex.Lock()
+	hooks := append([]func(int){}, b.reconnectHooks...)
+	b.hookMutex.Unlock()
+
+	for _, f := range hooks {
+		f(attempts)
+	}
+}
+
+// Logs an error that the bot can carry on from and passes it to the OnError
+// hooks.
+func (b *Bot) reportError(err error) {
+	if err == nil {
+		return
+	}
+	Error(err)
+
+	b.hookMutex.Lock()
+	hooks := append([]func(error){}, b.errorHooks...)
+	b.hookMutex.Unlock()
+
+	for _, f := range hooks {
+		f(err)
+	}
+}
@@ -1,5 +1,9 @@
 package sdbot
 
+import (
+	"os"
+)
+
 // LoggerList represents a list of Loggers with methods that allow you to
 // log to every one of them as per each loggers' individual logging behaviour.
 type LoggerList struct {
@@ -11,21 +15,54 @@ func NewLoggerList(loggers ...Logger) *LoggerList {
 	return &LoggerList{Loggers: loggers}
 }
 
-// loggers is the list of loggers that the bot will log to. Access to these
-// loggers is provided in the helpers in helpers.go exports.
-var loggers *LoggerList
+// Returns a LoggerList with the same loggers, which can be changed without
+// changing this one.
+func (lol *LoggerList) copy() *LoggerList {
+	return NewLoggerList(append([]Logger(nil), lol.Loggers...)...)
+}
+
+// defaultLogger is the logger that the package level helpers in helpers.go
+// log to. It is the only logging state kept by the package, since those
+// helpers have no Bot to log through.
+var defaultLogger Logger = &PrettyLogger{AnyLogger{Output: os.Stderr}}
+
+// defaultLoggers is the LoggerList of the deprecated package level AddLogger,
+// RemoveLogger, CheckErrAll and ErrorAll. Every new Bot starts with a copy of
+// it, so loggers added with AddLogger before NewBot still log for the bot.
+var defaultLoggers = NewLoggerList(defaultLogger)
 
-// AddLogger adds a logger to the LoggerList Loggers.
+// AddLogger adds a logger to the default LoggerList that new bots start with.
+//
+// Deprecated: Use Bot.AddLogger.
 func AddLogger(lo Logger) {
-	loggers.Loggers = append(loggers.Loggers, lo)
+	defaultLoggers.Loggers = append(defaultLoggers.Loggers, lo)
 }
 
-// RemoveLogger removes a logger from the LoggerLit Loggers.
-// Returns true if the logger was successfully removed.
+// RemoveLogger removes a logger from the default LoggerList that new bots
+// start with. Returns true if the logger was successfully removed.
+//
+// Deprecated: Use Bot.RemoveLogger.
 func RemoveLogger(lo Logger) bool {
-	for i, logger := range loggers.Loggers {
+	for i, logger := range defaultLoggers.Loggers {
+		if logger == lo {
+			defaultLoggers.Loggers = append(defaultLoggers.Loggers[:i], defaultLoggers.Loggers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// AddLogger adds a logger to the bot's LoggerList Loggers.
+func (b *Bot) AddLogger(lo Logger) {
+	b.Loggers.Loggers = append(b.Loggers.Loggers, lo)
+}
+
+// RemoveLogger removes a logger from the bot's LoggerList Loggers.
+// Returns true if the logger was successfully removed.
+func (b *Bot) RemoveLogger(lo Logger) bool {
+	for i, logger := range b.Loggers.Loggers {
 		if logger == lo {
-			loggers.Loggers = append(loggers.Loggers[:i], loggers.Loggers[i+1:]...)
+			b.Loggers.Loggers = append(b.Loggers.Loggers[:i], b.Loggers.Loggers[i+1:]...)
 			return true
 		}
 	}
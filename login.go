@@ -0,0 +1,259 @@
+package sdbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLoginServer is the action URL of the main Pokemon Showdown login
+// server. It is used unless the Config sets a LoginServer.
+const DefaultLoginServer = "https://play.pokemonshowdown.com/action.php"
+
+// ErrLoginFailed is returned when the bot could not log in to the server.
+// Every LoginError matches it with errors.Is.
+var ErrLoginFailed = errors.New("sdbot: login failed")
+
+// ErrNameTaken is returned when the nick is registered and no password was
+// given, or when the server refuses to give the bot its nick.
+var ErrNameTaken = errors.New("sdbot: nick is taken or registered")
+
+// ErrBadPassword is returned when the login server rejects the password.
+var ErrBadPassword = errors.New("sdbot: wrong password")
+
+// ErrLoginRateLimited is returned when the login server refuses to log the bot
+// in because it has attempted to log in too often.
+var ErrLoginRateLimited = errors.New("sdbot: too many login attempts")
+
+// LoginError is returned when the login server refuses to log the bot in. Err
+// is one of ErrLoginFailed, ErrNameTaken, ErrBadPassword or
+// ErrLoginRateLimited, and Message holds the reason given by the server.
+type LoginError struct {
+	Err        error
+	Message    string
+	StatusCode int
+}
+
+func (e *LoginError) Error() string {
+	if e.Message == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err.Error(), e.Message)
+}
+
+// Unwrap returns the kind of login error.
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every LoginError match ErrLoginFailed.
+func (e *LoginError) Is(target error) bool {
+	return target == ErrLoginFailed
+}
+
+// LoginClient obtains the assertion the bot sends with /trn to log in. The
+// challenge key id and challenge are the parameters of the challstr the
+// server sent. Replace Bot.LoginClient to log in some other way.
+type LoginClient interface {
+	Assertion(nick, password, challengeKeyID, challenge string) (string, error)
+}
+
+// HTTPLoginClient is the default LoginClient. It requests assertions from the
+// action.php endpoint of a login server. An assertion only holds for the
+// challstr it was requested with, so it cannot be reused, but the session the
+// login server opens when the bot logs in with its password can: for
+// SessionTTL after such a login, assertions for the same nick are requested
+// with the session cookie kept by the cookie jar of the Client, so that
+// reconnecting does not send the password again or run into the login rate
+// limit. The password is sent again if the session was dropped.
+type HTTPLoginClient struct {
+	ActionURL    string
+	Client       *http.Client
+	SessionTTL   time.Duration
+	sessionMutex sync.Mutex
+	sessions     map[string]time.Time
+}
+
+// NewHTTPLoginClient creates an HTTPLoginClient for the given action URL. An
+// empty URL uses the DefaultLoginServer.
+func NewHTTPLoginClient(actionURL string) *HTTPLoginClient {
+	if actionURL == "" {
+		actionURL = DefaultLoginServer
+	}
+	jar, _ := cookiejar.New(nil)
+	return &HTTPLoginClient{
+		ActionURL:  actionURL,
+		Client:     &http.Client{Timeout: 10 * time.Second, Jar: jar},
+		SessionTTL: 5 * time.Minute,
+		sessions:   make(map[string]time.Time),
+	}
+}
+
+// Assertion requests an assertion for the nick. Without a password, an
+// assertion for an unregistered nick is requested. Returns a *LoginError if
+// the login server refuses.
+func (lc *HTTPLoginClient) Assertion(nick, password, challengeKeyID, challenge string) (string, error) {
+	if password != "" && lc.loggedIn(nick) {
+		assertion, err := lc.request(nick, "", challengeKeyID, challenge)
+		if err == nil {
+			Debug("login: reusing the login session")
+			return assertion, nil
+		}
+		lc.forget(nick)
+	}
+
+	assertion, err := lc.request(nick, password, challengeKeyID, challenge)
+	if err == nil && password != "" {
+		lc.remember(nick)
+	}
+	return assertion, err
+}
+
+// Requests an assertion from the login server, logging in with the password
+// if there is one.
+func (lc *HTTPLoginClient) request(nick, password, challengeKeyID, challenge string) (string, error) {
+	var res *http.Response
+	var err error
+	if password == "" {
+		res, err = lc.Client.Get(lc.ActionURL + "?" + url.Values{
+			"act":            {"getassertion"},
+			"userid":         {Sanitize(nick)},
+			"challengekeyid": {challengeKeyID},
+			"challenge":      {challenge},
+		}.Encode())
+	} else {
+		res, err = lc.Client.PostForm(lc.ActionURL, url.Values{
+			"act":            {"login"},
+			"name":           {nick},
+			"pass":           {password},
+			"challengekeyid": {challengeKeyID},
+			"challenge":      {challenge},
+		})
+	}
+	if err != nil {
+		return "", &LoginError{Err: ErrLoginFailed, Message: err.Error()}
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", &LoginError{Err: ErrLoginFailed, Message: err.Error(), StatusCode: res.StatusCode}
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return "", &LoginError{Err: ErrLoginRateLimited, Message: res.Status, StatusCode: res.StatusCode}
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", &LoginError{Err: ErrLoginFailed, Message: res.Status, StatusCode: res.StatusCode}
+	}
+
+	var assertion string
+	if password == "" {
+		assertion = strings.TrimSpace(string(body))
+	} else {
+		assertion, err = parseLoginResponse(body)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := checkAssertion(assertion); err != nil {
+		return "", err
+	}
+	return assertion, nil
+}
+
+// Parses the JSON response to a login request. The login server prefixes its
+// JSON responses with "]".
+func parseLoginResponse(body []byte) (string, error) {
+	type LoginDetails struct {
+		ActionSuccess *bool `json:"actionsuccess"`
+		Assertion     string
+	}
+
+	s := strings.TrimPrefix(strings.TrimSpace(string(body)), "]")
+	if s == "" {
+		return "", &LoginError{Err: ErrLoginFailed, Message: "empty response from the login server"}
+	}
+
+	data := LoginDetails{}
+	err := json.Unmarshal([]byte(s), &data)
+	if err != nil {
+		return "", &LoginError{Err: ErrLoginFailed, Message: "malformed response from the login server"}
+	}
+
+	if data.ActionSuccess != nil && !*data.ActionSuccess && !strings.HasPrefix(data.Assertion, ";") {
+		return "", &LoginError{Err: ErrBadPassword}
+	}
+	return data.Assertion, nil
+}
+
+// Checks an assertion for the error messages the login server sends in its
+// place. A lone ";" means that the nick is registered, and ";;" prefixes an
+// error message.
+func checkAssertion(assertion string) error {
+	switch {
+	case assertion == "":
+		return &LoginError{Err: ErrLoginFailed, Message: "empty assertion"}
+	case assertion == ";":
+		return &LoginError{Err: ErrNameTaken, Message: "the nick is registered, a password is required"}
+	case strings.HasPrefix(assertion, ";;"):
+		msg := assertion[2:]
+		lower := strings.ToLower(msg)
+		switch {
+		case strings.Contains(lower, "password"):
+			return &LoginError{Err: ErrBadPassword, Message: msg}
+		case strings.Contains(lower, "too many"), strings.Contains(lower, "throttle"):
+			return &LoginError{Err: ErrLoginRateLimited, Message: msg}
+		case strings.Contains(lower, "registered"), strings.Contains(lower, "taken"), strings.Contains(lower, "in use"):
+			return &LoginError{Err: ErrNameTaken, Message: msg}
+		default:
+			return &LoginError{Err: ErrLoginFailed, Message: msg}
+		}
+	case strings.ContainsAny(assertion, "\n<"):
+		return &LoginError{Err: ErrLoginFailed, Message: "unexpected response from the login server"}
+	}
+	return nil
+}
+
+// Returns true if the nick logged in with its password less than SessionTTL
+// ago.
+func (lc *HTTPLoginClient) loggedIn(nick string) bool {
+	lc.sessionMutex.Lock()
+	defer lc.sessionMutex.Unlock()
+
+	expires, ok := lc.sessions[Sanitize(nick)]
+	if ok && time.Now().After(expires) {
+		delete(lc.sessions, Sanitize(nick))
+		return false
+	}
+	return ok
+}
+
+func (lc *HTTPLoginClient) remember(nick string) {
+	if lc.SessionTTL <= 0 {
+		return
+	}
+
+	lc.sessionMutex.Lock()
+	defer lc.sessionMutex.Unlock()
+
+	if lc.sessions == nil {
+		lc.sessions = make(map[string]time.Time)
+	}
+	lc.sessions[Sanitize(nick)] = time.Now().Add(lc.SessionTTL)
+}
+
+func (lc *HTTPLoginClient) forget(nick string) {
+	lc.sessionMutex.Lock()
+	defer lc.sessionMutex.Unlock()
+
+	delete(lc.sessions, Sanitize(nick))
+}
@@ -0,0 +1,100 @@
+package sdbot
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestLoginClientResponses tests that the HTTPLoginClient returns the
+// assertion on success and tells the different login failures apart.
+func TestLoginClientResponses(t *testing.T) {
+	tests := []struct {
+		password string
+		status   int
+		body     string
+		expected error
+	}{
+		{"", http.StatusOK, "assertion", nil},
+		{"", http.StatusOK, ";", ErrNameTaken},
+		{"", http.StatusOK, ";;Your username is already in use.", ErrNameTaken},
+		{"", http.StatusOK, ";;Too many unregistered logins.", ErrLoginRateLimited},
+		{"", http.StatusTooManyRequests, "", ErrLoginRateLimited},
+		{"", http.StatusInternalServerError, "", ErrLoginFailed},
+		{"pass", http.StatusOK, `]{"actionsuccess":true,"assertion":"assertion"}`, nil},
+		{"pass", http.StatusOK, `]{"actionsuccess":false,"assertion":";;Wrong password."}`, ErrBadPassword},
+		{"pass", http.StatusOK, `]{"actionsuccess":false}`, ErrBadPassword},
+		{"pass", http.StatusOK, `]nonsense`, ErrLoginFailed},
+	}
+
+	for i, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		lc := NewHTTPLoginClient(ts.URL)
+
+		assertion, err := lc.Assertion("Bot", test.password, "1", "challenge")
+		ts.Close()
+
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf(`test %d: err (%v) should == nil`, i, err)
+			}
+			if assertion != "assertion" {
+				t.Errorf(`test %d: assertion (%s) should == "assertion"`, i, assertion)
+			}
+			continue
+		}
+		if !errors.Is(err, test.expected) {
+			t.Errorf(`test %d: err (%v) should be %v`, i, err, test.expected)
+		}
+		if !errors.Is(err, ErrLoginFailed) {
+			t.Errorf(`test %d: err (%v) should be ErrLoginFailed`, i, err)
+		}
+	}
+}
+
+// TestLoginClientSession tests that after logging in with the password, the
+// next assertions are requested with the session cookie, and that the password
+// is sent again once the session is gone.
+func TestLoginClientSession(t *testing.T) {
+	logins, sessionID := 0, "abc"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("act") == "login" {
+			logins++
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: sessionID})
+			fmt.Fprintf(w, `]{"actionsuccess":true,"assertion":"%s"}`, r.Form.Get("challenge"))
+			return
+		}
+		if c, err := r.Cookie("sid"); err == nil && c.Value == sessionID {
+			fmt.Fprint(w, r.Form.Get("challenge"))
+			return
+		}
+		fmt.Fprint(w, ";")
+	}))
+	defer ts.Close()
+	lc := NewHTTPLoginClient(ts.URL)
+
+	for _, challenge := range []string{"one", "two"} {
+		assertion, err := lc.Assertion("Bot", "pass", "1", challenge)
+		if err != nil || assertion != challenge {
+			t.Errorf(`lc.Assertion (%s, %v) should == %s, nil`, assertion, err, challenge)
+		}
+	}
+	if logins != 1 {
+		t.Errorf(`logins (%d) should == 1`, logins)
+	}
+
+	sessionID = "def"
+	assertion, err := lc.Assertion("Bot", "pass", "1", "three")
+	if err != nil || assertion != "three" {
+		t.Errorf(`lc.Assertion (%s, %v) should == three, nil`, assertion, err)
+	}
+	if logins != 2 {
+		t.Errorf(`logins (%d) should == 2`, logins)
+	}
+}
@@ -2,14 +2,37 @@ package sdbot
 
 import (
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
+
+	"github.com/mikopits/sdbot/protocol"
+)
+
+// Kind tells what a Message carries.
+type Kind int
+
+// The kinds of messages. KindHTML is HTML shown in a room by a |raw|, |html|,
+// |uhtml| or |uhtmlchange| line, such as polls, announcements and the output
+// of other bots. The Message of these holds the HTML stripped to plain text,
+// and Parsed holds the HTML itself.
+const (
+	KindOther Kind = iota
+	KindChat
+	KindPrivate
+	KindHTML
 )
 
 // Message represents a message sent by a user to either a room the bot is
 // currently in, or to the bot via private messages. A message also defines
 // behaviour in its methods to reply to these messages.
+//
+// Parsed holds the message as parsed by the protocol package, so handlers can
+// tell messages apart with a type switch. It is nil if the message could not
+// be parsed.
+//
+// Backlog is set for chat messages that were sent before the bot joined the
+// room, which the server sends as history when the bot joins. Plugins only
+// receive them if they set Plugin.Backlog.
 type Message struct {
 	Bot       *Bot
 	Time      time.Time
@@ -21,108 +44,109 @@ type Message struct {
 	Auth      string
 	Target    Target
 	Message   string
+	Kind      Kind
+	Parsed    protocol.Message
+	Backlog   bool
 	Matches   map[string]map[*regexp.Regexp][]string
+	parseErr  error
+	args      map[*Plugin]parsedArgs
 }
 
-// NewMessage creates a new message and parses the message.
+// NewMessage creates a new message and parses the message. The string is the
+// room line, such as ">lobby" or an empty line, followed by a newline and the
+// line the server sent.
 func NewMessage(s string, bot *Bot) *Message {
 	m := &Message{
 		Bot:     bot,
 		Time:    time.Now(),
 		Matches: make(map[string]map[*regexp.Regexp][]string),
 	}
-	m.Command, m.Params, m.Timestamp, m.Room, m.User, m.Auth, m.Target, m.Message = parseMessage(s, bot)
+	m.parse(s)
 	return m
 }
 
-// Parse a raw message and return data in the following order:
-// Command, Params, Timestamp, Room, User, Auth, Target, Message
-// TODO Reduce cyclic complexity? Lots of ifs ands and switches.
-func parseMessage(s string, b *Bot) (string, []string, int, *Room, *User, string, Target, string) {
-	newlineDelimited := strings.Split(s, "\n")
-	vertbarDelimited := strings.Split(s, "|")
-
-	var command string
-	var params []string
-	var timestamp int
-	var room *Room
-	var user *User
-	var auth string
-	var message string
-
-	// The command is always after the first vertical bar.
-	if len(vertbarDelimited) < 2 {
-		command = "none"
+// Parses a raw message into the fields of the Message. Malformed lines do not
+// panic: Parsed is left nil and the error is kept for the connection to
+// report.
+func (m *Message) parse(s string) {
+	var roomLine, line string
+	if i := strings.Index(s, "\n"); i >= 0 {
+		roomLine, line = s[:i], s[i+1:]
 	} else {
-		command = string(vertbarDelimited[1])
-	}
-
-	// Parse the parameters following a command.
-	if command == "" {
-		params = []string{}
-	} else {
-		if len(vertbarDelimited) > 2 {
-			params = vertbarDelimited[2:]
-		} else {
-			params = []string{}
-		}
+		line = s
 	}
 
-	// Parse the timestamp of a chat event.
-	var err error
-	if strings.Contains(command, ":") {
-		timestamp, err = strconv.Atoi(params[0])
-		CheckErr(err)
+	var roomName string
+	if strings.HasPrefix(roomLine, ">") {
+		roomName = roomLine[1:]
+		m.Room = FindRoomEnsured(roomName, m.Bot)
 	} else {
-		timestamp = 0
+		m.Room = &Room{}
 	}
+	m.Target = m.Room
 
-	// If the message starts with a ">" then it comes from a room.
-	if newlineDelimited[0] == "" {
-		room = &Room{}
+	// The command is always after the first vertical bar.
+	m.Params = []string{}
+	if !strings.HasPrefix(line, "|") {
+		m.Command = "none"
+		m.Message = line
 	} else {
-		if string(newlineDelimited[0][0]) == ">" {
-			room = FindRoomEnsured(string(newlineDelimited[0][1:]), b)
-		} else {
-			room = &Room{}
+		parts := strings.Split(line[1:], "|")
+		m.Command = parts[0]
+		if m.Command != "" {
+			m.Params = parts[1:]
 		}
 	}
 
-	// Parse the user sending a command, and their auth level.
-	switch strings.ToLower(command) {
-	case "c:":
-		auth = string(vertbarDelimited[3][0])
-		user = FindUserEnsured(string(vertbarDelimited[3][1:]), b)
-	case "c":
-		fallthrough
-	case "j":
-		fallthrough
-	case "l":
-		fallthrough
-	case "n":
-		fallthrough
-	case "pm":
-		auth = string(vertbarDelimited[2][0])
-		user = FindUserEnsured(string(vertbarDelimited[2][1:]), b)
+	m.Parsed, m.parseErr = protocol.Parse(roomName, line)
+
+	switch p := m.Parsed.(type) {
+	case *protocol.Chat:
+		m.Kind = KindChat
+		m.Timestamp = int(p.Timestamp)
+		m.setUser(p.User)
+		m.Message = p.Message
+	case *protocol.PM:
+		m.Kind = KindPrivate
+		m.setUser(p.From)
+		m.setGlobalAuth(p.From.Rank)
+		m.Message = p.Message
+		m.Target = m.User
+	case *protocol.Raw:
+		m.Kind = KindHTML
+		m.Message = StripHTML(p.HTML)
+	case *protocol.HTML:
+		m.Kind = KindHTML
+		m.Message = StripHTML(p.HTML)
+	case *protocol.UHTML:
+		m.Kind = KindHTML
+		m.Message = StripHTML(p.HTML)
+	case *protocol.Join:
+		m.setUser(p.User)
+	case *protocol.Leave:
+		m.setUser(p.User)
+	case *protocol.Name:
+		m.setUser(p.User)
+	case *protocol.Timestamp:
+		m.Timestamp = int(p.Timestamp)
 	}
+}
 
-	// Parse the message
-	if command == "" {
-		message = ""
-	} else {
-		switch strings.ToLower(command) {
-		case "c:", "pm":
-			message = strings.Join(vertbarDelimited[4:], "|")
-		case "none":
-			message = newlineDelimited[len(newlineDelimited)-1]
-		}
-	}
+// Sets the user who sent the message and their auth level.
+func (m *Message) setUser(u protocol.User) {
+	m.Auth = u.Rank
+	m.User = FindUserEnsured(u.Name, m.Bot)
+}
 
-	// Decide the target
-	if strings.ToLower(command) == "pm" {
-		return command, params, timestamp, room, user, auth, user, message
+// Sets the global rank of the sender, under the lock the UserList is updated
+// with, since the user may be in use by plugins.
+func (m *Message) setGlobalAuth(rank string) {
+	u := m.User
+	var setAuth = func() interface{} {
+		u.GlobalAuth = rank
+		return nil
 	}
-	return command, params, timestamp, room, user, auth, room, message
+	m.Bot.Synchronize("room", &setAuth)
 }
 
 // Reply responds to a message and prepends the username of the user the bot
@@ -132,14 +156,19 @@ func (m *Message) Reply(res string) {
 }
 
 // RawReply responds to a message without prepending anything to the message.
-// Note that you should take care to not allow users to influence a raw
-// reply message to do a client command. For this reason, prefer to use
-// Reply unless you are responding with a static message. You may want to
-// event freeze the string.
+// The response is escaped so that it cannot run a command, unless the Config
+// sets AllowRawCommands. Use RunCommand to run a command on purpose.
 func (m *Message) RawReply(res string) {
 	m.Target.RawReply(m, res)
 }
 
+// RunCommand runs a server command where the message was sent, such as
+// m.RunCommand("roomban", name, "spam"). See Bot.Command for the name and
+// arguments.
+func (m *Message) RunCommand(name string, args ...string) error {
+	return m.Target.Command(m, name, args...)
+}
+
 // Match adds matches to the message and return true if there was no previous
 // match and if there was indeed a match.
 func (m *Message) Match(r *regexp.Regexp, event string) bool {
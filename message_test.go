@@ -2,13 +2,15 @@ package sdbot
 
 import (
 	"testing"
+
+	"github.com/mikopits/sdbot/protocol"
 )
 
 // TestParseChatMessage tests that the parseMessage function can correctly
 // parse the details of an incoming chat message and properly unload them
 // into a Message struct.
 func TestParseChatMessage(t *testing.T) {
-	b := NewBot("examples/config/config_example.toml")
+	b := initBot()
 	chatMsg := ">testroom\n|c:|100|+Mystifi|ayylmao"
 	m := NewMessage(chatMsg, b)
 
@@ -63,3 +65,116 @@ func TestParseChatMessage(t *testing.T) {
 		t.Errorf(`m.Message (%s) should == m.Params[2] (%s)`, m.Message, m.Params[2])
 	}
 }
+
+// TestParseMalformedMessage tests that malformed messages do not panic, and
+// are not passed on to the handlers.
+func TestParseMalformedMessage(t *testing.T) {
+	b := initBot()
+	for _, s := range []string{">testroom\n|c:|100", ">testroom\n|j|", "\n|users|", "\n|n|+User"} {
+		m := NewMessage(s, b)
+		if m.Parsed != nil || m.parseErr == nil {
+			t.Errorf(`NewMessage(%q) should not be parsed`, s)
+		}
+		b.Connection.parse(s, false)
+	}
+}
+
+// TestHandlersUnparsed tests that the handlers do not panic on messages that
+// were not parsed as the type they expect.
+func TestHandlersUnparsed(t *testing.T) {
+	b := initBot()
+	handlers := []func(*Message){onNametaken, onUpdateuser, onNick, onTitle, onUsers, onPopup, onFormats, onQueryResponse}
+	for _, h := range handlers {
+		h(&Message{Bot: b, Room: &Room{Name: "testroom"}, User: NewUser("Tympy")})
+	}
+}
+
+// TestParsedMessage tests that the parsed message is kept for handlers.
+func TestParsedMessage(t *testing.T) {
+	b := initBot()
+	m := NewMessage(">testroom\n|pm|+Mystifi| Bot|hi", b)
+	pm, ok := m.Parsed.(*protocol.PM)
+	if !ok {
+		t.Fatalf(`m.Parsed (%T) should be *protocol.PM`, m.Parsed)
+	}
+	if pm.From.Name != "Mystifi" || m.User.Name != "Mystifi" || m.Message != "hi" {
+		t.Errorf(`pm (%+v) should be from Mystifi`, pm)
+	}
+	if !m.Private() {
+		t.Error(`m.Private() should be true`)
+	}
+}
+
+// TestInitFrame tests that the frame sent when the bot joins a room sets the
+// title and users of the room, and that its chat messages are marked as
+// backlog while later ones are not.
+func TestInitFrame(t *testing.T) {
+	b := initBot()
+	var chat []*Message
+	b.handlers["c:"] = func(m *Message) { chat = append(chat, m) }
+
+	b.Connection.readFrame(">testroom\n|init|chat\n|title|Test Room\n|users|2,@Mod,+Voice\n|:|200\n|c:|150|@Mod|old\n|c:|200|+Voice|same second")
+	b.Connection.readFrame(">testroom\n|c:|201|@Mod|new")
+
+	r := b.RoomList["testroom"]
+	if r == nil {
+		t.Fatal(`room "testroom" not instantiated`)
+	}
+	if r.Title != "Test Room" {
+		t.Errorf(`r.Title (%s) should == "Test Room"`, r.Title)
+	}
+	if len(r.Users) != 2 {
+		t.Errorf(`len(r.Users) (%d) should == 2`, len(r.Users))
+	}
+	if b.UserList["mod"] == nil || b.UserList["mod"].Auths["testroom"] != Moderator {
+		t.Error(`user "mod" should be a moderator of "testroom"`)
+	}
+
+	if len(chat) != 3 {
+		t.Fatalf(`len(chat) (%d) should == 3`, len(chat))
+	}
+	if !chat[0].Backlog || !chat[1].Backlog {
+		t.Error(`the chat messages of the init frame should be backlog`)
+	}
+	if chat[2].Backlog {
+		t.Error(`chat[2] should not be backlog`)
+	}
+
+	// Joining again replaces the users of the room.
+	b.Connection.readFrame(">testroom\n|init|chat\n|users|1,@Mod")
+	if len(r.Users) != 1 {
+		t.Errorf(`len(r.Users) (%d) should == 1 after joining again`, len(r.Users))
+	}
+}
+
+// TestHTMLMessage tests that HTML lines are parsed into HTML messages with
+// their text stripped for matching, and that plugins only receive them if
+// they ask for them.
+func TestHTMLMessage(t *testing.T) {
+	b := initBot()
+	m := NewMessage(">testroom\n|uhtml|poll|<div class=\"broadcast-blue\"><b>Poll:</b> Best&nbsp;starter?<br />Bulbasaur</div>", b)
+
+	if m.Kind != KindHTML {
+		t.Errorf(`m.Kind (%d) should == KindHTML`, m.Kind)
+	}
+	if m.Message != "Poll: Best starter? Bulbasaur" {
+		t.Errorf(`m.Message (%q) should == "Poll: Best starter? Bulbasaur"`, m.Message)
+	}
+
+	p := NewPluginWithoutCommand()
+	if p.accepts(m) {
+		t.Error(`a plugin without Kinds should not accept HTML`)
+	}
+	p.Kinds = []Kind{KindHTML}
+	if !p.accepts(m) {
+		t.Error(`a plugin with KindHTML should accept HTML`)
+	}
+
+	chat := NewMessage(">testroom\n|c|+Mystifi|hi", b)
+	if chat.Kind != KindChat || chat.User.Name != "Mystifi" || chat.Message != "hi" {
+		t.Errorf(`chat (%+v) should be a chat message from Mystifi`, chat)
+	}
+	if p.accepts(chat) {
+		t.Error(`a plugin with only KindHTML should not accept chat`)
+	}
+}
@@ -0,0 +1,106 @@
+package sdbot
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// PanicError is reported to the OnError hooks when the event handler of a
+// plugin panics. Message is the text of the message that was being handled,
+// which is empty for timed plugins, and Stack is the stack trace of the
+// panic.
+type PanicError struct {
+	Plugin  string
+	Message string
+	Value   interface{}
+	Stack   []byte
+}
+
+func (e *PanicError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("sdbot: plugin `%s` panicked: %v\n%s", e.Plugin, e.Value, e.Stack)
+	}
+	return fmt.Sprintf("sdbot: plugin `%s` panicked handling %q: %v\n%s", e.Plugin, e.Message, e.Value, e.Stack)
+}
+
+// Failures returns the number of times the event handler of the plugin has
+// panicked.
+func (p *Plugin) Failures() uint64 {
+	return atomic.LoadUint64(&p.failures)
+}
+
+// Disabled returns true if the plugin was disabled for panicking too often.
+func (p *Plugin) Disabled() bool {
+	return atomic.LoadInt32(&p.disabled) == 1
+}
+
+// Enable enables a plugin that was disabled for panicking too often.
+func (p *Plugin) Enable() {
+	atomic.StoreInt32(&p.consecutivePanics, 0)
+	atomic.StoreInt32(&p.disabled, 0)
+}
+
+// Recovers from a panic of the plugin's event handler, reports it, replies
+// with the PluginPanicReply of the Config if there is one, and disables the
+// plugin once it has panicked PluginMaxPanics times in a row. Must be
+// deferred.
+func (p *Plugin) recover(m *Message) {
+	v := recover()
+	if v == nil {
+		atomic.StoreInt32(&p.consecutivePanics, 0)
+		return
+	}
+
+	atomic.AddUint64(&p.failures, 1)
+	p.Bot.reportError(&PanicError{Plugin: p.Name, Message: m.Message, Value: v, Stack: debug.Stack()})
+
+	if reply := p.Bot.Config.PluginPanicReply; reply != "" && m.Target != nil {
+		m.Reply(reply)
+	}
+
+	n := atomic.AddInt32(&p.consecutivePanics, 1)
+	if max := p.Bot.Config.PluginMaxPanics; max > 0 && int(n) >= max {
+		if atomic.CompareAndSwapInt32(&p.disabled, 0, 1) {
+			Warnf("Plugin `%s` was disabled after panicking %d times in a row.", p.Name, n)
+		}
+	}
+}
+
+// Failures returns the number of times the event handler of the timed plugin
+// has panicked.
+func (tp *TimedPlugin) Failures() uint64 {
+	return atomic.LoadUint64(&tp.failures)
+}
+
+// Disabled returns true if the timed plugin was disabled for panicking too
+// often.
+func (tp *TimedPlugin) Disabled() bool {
+	return atomic.LoadInt32(&tp.disabled) == 1
+}
+
+// Enable enables a timed plugin that was disabled for panicking too often.
+func (tp *TimedPlugin) Enable() {
+	atomic.StoreInt32(&tp.consecutivePanics, 0)
+	atomic.StoreInt32(&tp.disabled, 0)
+}
+
+// Recovers from a panic of the timed plugin's event handler like
+// Plugin.recover does, without replying. Must be deferred.
+func (tp *TimedPlugin) recover() {
+	v := recover()
+	if v == nil {
+		atomic.StoreInt32(&tp.consecutivePanics, 0)
+		return
+	}
+
+	atomic.AddUint64(&tp.failures, 1)
+	tp.Bot.reportError(&PanicError{Plugin: tp.Name, Value: v, Stack: debug.Stack()})
+
+	n := atomic.AddInt32(&tp.consecutivePanics, 1)
+	if max := tp.Bot.Config.PluginMaxPanics; max > 0 && int(n) >= max {
+		if atomic.CompareAndSwapInt32(&tp.disabled, 0, 1) {
+			Warnf("Timed plugin `%s` was disabled after panicking %d times in a row.", tp.Name, n)
+		}
+	}
+}
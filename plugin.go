@@ -1,9 +1,12 @@
 package sdbot
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,13 +15,26 @@ import (
 // It can trigger on several different formats (consider prefix "." and
 // command "cmd"). Note that cooldowns will not affect command syntax, but
 // will ignore the commands hould it have been sent less than Cooldown time
-// from the last instance.
+// from the last instance. The CooldownScope decides whether that instance is
+// the last use anywhere, in the room, by the user or by the user in the room.
+// Users with at least the CooldownExempt rank, and the owners of the bot, do
+// not wait for the cooldown. CooldownReply overrides the PluginCooldownReply
+// of the Config. LastUsed is the last time the plugin was used in any scope.
 //
 // NewPlugin: ".cmd"
 // NewPluginWithArgs:
-//   1 arg:  ".cmd arg0"
-//   2 args: ".cmd arg0, arg1" (space is optional)
-//   n args: ".cmd arg0,arg1,arg2,arg3, ...,arg n" (space is optional)
+//
+//	1 arg:  ".cmd arg0"
+//	2 args: ".cmd arg0, arg1" (space is optional)
+//	n args: ".cmd arg0,arg1,arg2,arg3, ...,arg n" (space is optional)
+//
+// Description says what the plugin does in the help of a CommandGroup.
+//
+// Args declares the arguments of the plugin instead of NumArgs. The message
+// then matches whatever follows the command, and the arguments are checked
+// against the Args before the plugin handles it: if they do not fit, the user
+// is replied to with the Usage of the plugin. The parsed arguments are in the
+// Values of the Context.
 //
 // It is possible to define a Command with a regexp string. For example,
 // a command of "y|n" will trigger on either y or n.
@@ -28,20 +44,65 @@ import (
 // the string of either "ay" or "peak", depending on which triggered the
 // message.
 //
-// Each fired event is run in its own separate goroutine, so for anything
-// that must be run sequentially (ie. cannot read and write to the same file
-// at once) use Bot.Synchronize.
+// Events are handled by a pool of Concurrency workers, so up to Concurrency
+// events run at once, and the rest wait in a queue of QueueLength messages.
+// For anything that must be run sequentially (ie. cannot read and write to
+// the same file at once) use Bot.Synchronize, or set Concurrency to 1. The
+// defaults are the PluginConcurrency and PluginQueueLength of the Config. An
+// EventHandler that is also a ContextEventHandler is passed a context that
+// expires after Timeout, or the PluginTimeout of the Config. A Handler is
+// used instead of the EventHandler if it is set, and is passed a Context
+// with that deadline.
+//
+// Set Backlog to also receive the chat messages that were sent before the bot
+// joined a room, such as to catch up on what was said while it was away.
+// Kinds lists the kinds of messages the plugin receives. It receives chat and
+// private messages if Kinds is empty. Add KindHTML to match the HTML shown in
+// rooms, such as polls. Overflow overrides the PluginOverflow of the Config
+// for this plugin.
+//
+// Auth is the auth level a user needs to use the plugin, see RequireAuth and
+// RequireGlobalAuth. DenialReply overrides the AuthDenialReply of the Config.
+//
+// A panic in the EventHandler is recovered and reported to the OnError hooks.
+// The plugin is disabled after PluginMaxPanics panics in a row, until Enable
+// is called.
 type Plugin struct {
-	Bot          *Bot
-	Name         string
-	Prefix       *regexp.Regexp
-	Suffix       *regexp.Regexp
-	Command      string
-	NumArgs      int
-	Cooldown     time.Duration
-	LastUsed     time.Time
-	EventHandler EventHandler
-	kill         chan struct{}
+	Bot               *Bot
+	Name              string
+	Prefix            *regexp.Regexp
+	Suffix            *regexp.Regexp
+	Command           string
+	Description       string
+	NumArgs           int
+	Args              []Arg
+	Cooldown          time.Duration
+	CooldownScope     string
+	CooldownExempt    string
+	CooldownReply     string
+	LastUsed          time.Time
+	EventHandler      EventHandler
+	Handler           HandlerFunc
+	Backlog           bool
+	Kinds             []Kind
+	Overflow          string
+	Concurrency       int
+	QueueLength       int
+	Timeout           time.Duration
+	Auth              string
+	GlobalAuth        bool
+	AuthRoom          string
+	DenialReply       string
+	group             *CommandGroup
+	kill              chan struct{}
+	cancel            context.CancelFunc
+	usedMutex         sync.Mutex
+	used              map[string]*cooldownEntry
+	swept             time.Time
+	dropped           uint64
+	failures          uint64
+	consecutivePanics int32
+	disabled          int32
 }
 
 // TimedPlugin structs will fire an event on a regular schedule defined by the
@@ -53,14 +114,26 @@ type Plugin struct {
 // Because each event fires in its own goroutine, you should take care to not
 // have each event take longer than the duration of the ticker, or else you
 // will be spawning goroutines faster than you can finish them, which is a
-// recipe for disaster.
+// recipe for disaster. Set SkipIfRunning to skip the ticks that come while
+// the last event is still running instead. A TimedEventHandler that is also a
+// ContextTimedEventHandler is passed a context that expires after Timeout, or
+// after Period if Timeout is not set. Panics are recovered and disable the
+// timed plugin like they do a Plugin.
 type TimedPlugin struct {
 	Bot               *Bot
 	Name              string
 	Ticker            *time.Ticker
 	Period            time.Duration
 	TimedEventHandler TimedEventHandler
+	SkipIfRunning     bool
+	Timeout           time.Duration
+	runMutex          sync.Mutex
 	kill              chan struct{}
+	cancel            context.CancelFunc
+	running           int32
+	failures          uint64
+	consecutivePanics int32
+	disabled          int32
 }
 
 // DefaultEventHandler is the default event handler that you can make use of
@@ -140,6 +213,12 @@ func (p *Plugin) SetEventHandler(eh EventHandler) {
 	p.EventHandler = eh
 }
 
+// SetHandler sets the HandlerFunc of the Plugin, which is used instead of its
+// EventHandler.
+func (p *Plugin) SetHandler(h HandlerFunc) {
+	p.Handler = h
+}
+
 // SetEventHandler sets the TimedEventHandler of the TimedPlugin.
 // The TimedEventHandler of every TimedPlugin MUST be set after its creation.
 func (tp *TimedPlugin) SetEventHandler(teh TimedEventHandler) {
@@ -147,34 +226,42 @@ func (tp *TimedPlugin) SetEventHandler(teh TimedEventHandler) {
 }
 
 // SetPrefix overrides the Plugin's default Prefix as read by the Config.
-func (p *Plugin) SetPrefix(prefixes []string) {
+// Returns an error if the prefixes do not form a valid regexp.
+func (p *Plugin) SetPrefix(prefixes []string) error {
 	if len(prefixes) == 0 {
-		return
+		return nil
 	}
 
 	regStr := "^(" + strings.Join(prefixes, "|") + ")"
 	reg, err := regexp.Compile(regStr)
-	CheckErr(err)
+	if err != nil {
+		return err
+	}
 
 	p.Prefix = reg
+	return nil
 }
 
 // SetSuffix overrides the Plugin's default Suffix as read by the Config.
-func (p *Plugin) SetSuffix(suffixes []string) {
+// Returns an error if the suffixes do not form a valid regexp.
+func (p *Plugin) SetSuffix(suffixes []string) error {
 	if len(suffixes) == 0 {
-		return
+		return nil
 	}
 
 	regStr := "(" + strings.Join(suffixes, "|") + ")$"
 	reg, err := regexp.Compile(regStr)
-	CheckErr(err)
+	if err != nil {
+		return err
+	}
 
 	p.Suffix = reg
+	return nil
 }
 
 // Formats the prefixes and suffixes into the regexp that will be used to match
-// messages.
-func (p *Plugin) formatPrefixAndSuffix() {
+// messages. Returns an error if the Command does not form a valid regexp.
+func (p *Plugin) formatPrefixAndSuffix() error {
 	ps := p.Prefix.String()
 	ss := p.Suffix.String()
 	var flags string
@@ -184,7 +271,10 @@ func (p *Plugin) formatPrefixAndSuffix() {
 		flags = "(?i)"
 	}
 
-	if p.NumArgs > 0 {
+	var prefix string
+	if len(p.Args) > 0 {
+		prefix = fmt.Sprintf("^(%s%s%s(?: +(.*))?$)", flags, ps[1:], p.Command)
+	} else if p.NumArgs > 0 {
 		if p.NumArgs == 1 {
 			args = " +(.+)"
 		} else {
@@ -197,14 +287,23 @@ func (p *Plugin) formatPrefixAndSuffix() {
 				args = strings.Join([]string{args, ", +([^,]+)"}, "")
 			}
 		}
+		prefix = fmt.Sprintf("^(%s%s%s%s)", flags, ps[1:], p.Command, args)
 	} else {
-		p.Prefix = regexp.MustCompile(fmt.Sprintf("^(%s%s%s$)", flags, ps[1:], p.Command))
-		p.Suffix = regexp.MustCompile(fmt.Sprintf("(%s%s)$", flags, ss[:len(ss)-1]))
-		return
+		prefix = fmt.Sprintf("^(%s%s%s$)", flags, ps[1:], p.Command)
 	}
 
-	p.Prefix = regexp.MustCompile(fmt.Sprintf("^(%s%s%s%s)", flags, ps[1:], p.Command, args))
-	p.Suffix = regexp.MustCompile(fmt.Sprintf("(%s%s)$", flags, ss[:len(ss)-1]))
+	prefixReg, err := regexp.Compile(prefix)
+	if err != nil {
+		return err
+	}
+	suffixReg, err := regexp.Compile(fmt.Sprintf("(%s%s)$", flags, ss[:len(ss)-1]))
+	if err != nil {
+		return err
+	}
+
+	p.Prefix = prefixReg
+	p.Suffix = suffixReg
+	return nil
 }
 
 // Find out if the message is a match for this plugin.
@@ -212,6 +311,26 @@ func (p *Plugin) match(m *Message) bool {
 	return p.Prefix.MatchString(m.Message) && p.Suffix.MatchString(m.Message)
 }
 
+// Returns true if the plugin receives messages of this kind, and backlog if
+// the message is backlog. Disabled plugins receive nothing.
+func (p *Plugin) accepts(m *Message) bool {
+	if p.Disabled() {
+		return false
+	}
+	if m.Backlog && !p.Backlog {
+		return false
+	}
+	if len(p.Kinds) == 0 {
+		return m.Kind == KindChat || m.Kind == KindPrivate
+	}
+	for _, k := range p.Kinds {
+		if k == m.Kind {
+			return true
+		}
+	}
+	return false
+}
+
 // Parse the message. Returns the arguments provided to the message.
 func (p *Plugin) parse(m *Message) []string {
 	submatches := p.Prefix.FindStringSubmatch(m.Message)
@@ -224,60 +343,150 @@ func (p *Plugin) parse(m *Message) []string {
 	}
 }
 
-// Starts a loop in its own goroutine listening for events.
+// Starts the workers of the plugin, which handle the messages that the router
+// passes on. The workers share the plugin's queues, so at most Concurrency
+// events are handled at once.
 func (p *Plugin) listen() {
-	go func() {
-		for {
-			select {
-			case m := <-p.Bot.pluginChatChannelsRead(p.Name):
-				if !p.Bot.Config.IgnoreChatMessages && p.match(m) {
-					args := p.parse(m)
-					Debugf("[on plugin] Starting chat event handler goroutine for plugin `%s` with args `%+v`", p.Name, args)
-					if m.Time.Sub(p.LastUsed) > p.Cooldown {
-						p.LastUsed = m.Time
-						go p.EventHandler.HandleEvent(m, args)
-					}
-				}
-			case m := <-p.Bot.pluginPrivateChannelsRead(p.Name):
-				if !p.Bot.Config.IgnorePrivateMessages && p.match(m) {
-					args := p.parse(m)
-					Debugf("[on plugin] Starting private event handler goroutine for plugin `%s` with args `%+v`", p.Name, args)
-					if m.Time.Sub(p.LastUsed) > p.Cooldown {
-						p.LastUsed = m.Time
-						go p.EventHandler.HandleEvent(m, args)
-					}
+	p.kill = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	chat := p.Bot.pluginChatChannelsRead(p.Name)
+	private := p.Bot.pluginPrivateChannelsRead(p.Name)
+
+	concurrency := p.Concurrency
+	if concurrency <= 0 {
+		concurrency = p.Bot.Config.PluginConcurrency
+	}
+	for i := 0; i < concurrency; i++ {
+		go func(kill chan struct{}) {
+			for {
+				select {
+				case m := <-chat:
+					p.handle(ctx, m, "chat")
+				case m := <-private:
+					p.handle(ctx, m, "private")
+				case <-kill:
+					return
 				}
-			case <-p.kill:
-				return
 			}
-		}
-	}()
+		}(p.kill)
+	}
+}
+
+// Handles an event with a context that expires after the plugin's Timeout.
+func (p *Plugin) handle(ctx context.Context, m *Message, kind string) {
+	defer p.recover(m)
+
+	// The router parsed the Args already, in the goroutine reading the
+	// connection where the bot's state can be looked up safely.
+	args := p.parse(m)
+	values := make(ArgValues)
+	if parsed, ok := m.args[p]; ok {
+		args, values = parsed.given, parsed.values
+	}
+	Debugf("[on plugin] Handling %s event for plugin `%s` with args `%+v`", kind, p.Name, args)
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = time.Duration(p.Bot.Config.PluginTimeout * float64(time.Second))
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c := &Context{
+		Context: ctx,
+		Bot:     p.Bot,
+		Plugin:  p,
+		Message: m,
+		Args:    args,
+		Values:  values,
+		Log:     &PluginLogger{bot: p.Bot, name: p.Name},
+	}
+	if err := p.handler()(c); err != nil {
+		p.Bot.reportError(fmt.Errorf("sdbot: plugin `%s` failed handling %q: %w", p.Name, m.Message, err))
+	}
 }
 
-// Request the termination of the Plugin.Listen loop.
+// Request the termination of the plugin's workers. Events that are being
+// handled have their context cancelled. Does nothing if the Plugin is not
+// listening.
 func (p *Plugin) stopListening() {
-	p.kill <- struct{}{}
+	if p.kill == nil {
+		return
+	}
+	close(p.kill)
+	p.cancel()
+	p.kill = nil
 }
 
-// Starts a loop listening on the time.Ticker.
+// Starts a loop listening on the time.Ticker. Does nothing if the TimedPlugin
+// is already running. It may be called concurrently with stop, from the
+// goroutines of the connection and from Shutdown.
 func (tp *TimedPlugin) start() {
+	tp.runMutex.Lock()
+	defer tp.runMutex.Unlock()
+
+	if tp.kill != nil {
+		return
+	}
+	tp.kill = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	tp.cancel = cancel
 	tp.Ticker = time.NewTicker(tp.Period)
-	go func() {
+	go func(ticker *time.Ticker, kill chan struct{}) {
 		for {
 			select {
-			case <-tp.Ticker.C:
-				go tp.TimedEventHandler.HandleEvent()
-			case <-tp.kill:
+			case <-ticker.C:
+				if tp.Disabled() {
+					continue
+				}
+				if tp.SkipIfRunning && atomic.LoadInt32(&tp.running) > 0 {
+					Debugf("[on timed plugin] Skipping event of `%s`, the last one is still running", tp.Name)
+					continue
+				}
+				atomic.AddInt32(&tp.running, 1)
+				go tp.handle(ctx)
+			case <-kill:
 				return
 			}
 		}
-	}()
+	}(tp.Ticker, tp.kill)
+}
+
+// Handles an event with a context that expires after the timed plugin's
+// Timeout.
+func (tp *TimedPlugin) handle(ctx context.Context) {
+	defer atomic.AddInt32(&tp.running, -1)
+	defer tp.recover()
+
+	timeout := tp.Timeout
+	if timeout <= 0 {
+		timeout = tp.Period
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if teh, ok := tp.TimedEventHandler.(ContextTimedEventHandler); ok {
+		teh.HandleEventContext(ctx)
+		return
+	}
+	tp.TimedEventHandler.HandleEvent()
 }
 
-// Request the termination of the TimedPlugin.Start loop.
+// Request the termination of the TimedPlugin.Start loop. Events that are
+// running have their context cancelled. Does nothing if the TimedPlugin is not
+// running.
 func (tp *TimedPlugin) stop() {
+	tp.runMutex.Lock()
+	defer tp.runMutex.Unlock()
+
+	if tp.kill == nil {
+		return
+	}
 	tp.Ticker.Stop()
-	tp.kill <- struct{}{}
+	close(tp.kill)
+	tp.cancel()
+	tp.kill = nil
 }
 
 // EventHandler defines the behaviour and action of any event on a Plugin. Use
@@ -294,3 +503,20 @@ type EventHandler interface {
 type TimedEventHandler interface {
 	HandleEvent()
 }
+
+// ContextEventHandler is an EventHandler that is passed a context along with
+// the event. The context expires after the Timeout of the Plugin, and is
+// cancelled when the plugin is stopped. HandleEventContext is called instead
+// of HandleEvent.
+type ContextEventHandler interface {
+	EventHandler
+	HandleEventContext(context.Context, *Message, []string)
+}
+
+// ContextTimedEventHandler is a TimedEventHandler that is passed a context
+// that expires after the Timeout of the TimedPlugin, and is cancelled when the
+// plugin is stopped. HandleEventContext is called instead of HandleEvent.
+type ContextTimedEventHandler interface {
+	TimedEventHandler
+	HandleEventContext(context.Context)
+}
@@ -0,0 +1,204 @@
+package sdbot
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type blockingEventHandler struct {
+	mutex   sync.Mutex
+	running int
+	max     int
+	release chan struct{}
+	done    sync.WaitGroup
+}
+
+func (eh *blockingEventHandler) HandleEvent(m *Message, args []string) {
+	eh.mutex.Lock()
+	eh.running++
+	if eh.running > eh.max {
+		eh.max = eh.running
+	}
+	eh.mutex.Unlock()
+
+	<-eh.release
+
+	eh.mutex.Lock()
+	eh.running--
+	eh.mutex.Unlock()
+	eh.done.Done()
+}
+
+// TestPluginConcurrency tests that a plugin handles at most Concurrency events
+// at once.
+func TestPluginConcurrency(t *testing.T) {
+	b := initBot()
+	eh := &blockingEventHandler{release: make(chan struct{})}
+	p := NewPlugin("slow")
+	p.Concurrency = 2
+	p.SetEventHandler(eh)
+	if err := b.RegisterPlugin(p, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	eh.done.Add(5)
+	for i := 0; i < 5; i++ {
+		b.pluginChatChannelsWrite(p, &Message{Bot: b, Message: ".slow"})
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(eh.release)
+	eh.done.Wait()
+
+	if eh.max != 2 {
+		t.Errorf(`eh.max (%d) should == 2`, eh.max)
+	}
+}
+
+type contextEventHandler struct {
+	err chan error
+}
+
+func (eh *contextEventHandler) HandleEvent(m *Message, args []string) {
+	eh.err <- nil
+}
+
+func (eh *contextEventHandler) HandleEventContext(ctx context.Context, m *Message, args []string) {
+	<-ctx.Done()
+	eh.err <- ctx.Err()
+}
+
+// TestPluginTimeout tests that a ContextEventHandler is passed a context that
+// expires after the plugin's Timeout.
+func TestPluginTimeout(t *testing.T) {
+	b := initBot()
+	eh := &contextEventHandler{err: make(chan error, 1)}
+	p := NewPlugin("deadline")
+	p.Timeout = 10 * time.Millisecond
+	p.SetEventHandler(eh)
+	if err := b.RegisterPlugin(p, "deadline"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	b.pluginChatChannelsWrite(p, &Message{Bot: b, Message: ".deadline"})
+	select {
+	case err := <-eh.err:
+		if err != context.DeadlineExceeded {
+			t.Errorf(`err (%v) should == context.DeadlineExceeded`, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`the context should have expired`)
+	}
+}
+
+type countingTimedEventHandler struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (teh *countingTimedEventHandler) HandleEvent() {
+	atomic.AddInt32(&teh.calls, 1)
+	<-teh.release
+}
+
+// TestTimedPluginSkipIfRunning tests that the ticks of a timed plugin are
+// skipped while its last event is still running.
+func TestTimedPluginSkipIfRunning(t *testing.T) {
+	teh := &countingTimedEventHandler{release: make(chan struct{})}
+	tp := NewTimedPlugin(2 * time.Millisecond)
+	tp.SkipIfRunning = true
+	tp.SetEventHandler(teh)
+
+	tp.start()
+	time.Sleep(30 * time.Millisecond)
+	tp.stop()
+	close(teh.release)
+
+	if calls := atomic.LoadInt32(&teh.calls); calls != 1 {
+		t.Errorf(`teh.calls (%d) should == 1`, calls)
+	}
+}
+
+// TestTimedPluginConcurrentStartStop tests that a timed plugin can be started
+// and stopped from several goroutines at once.
+func TestTimedPluginConcurrentStartStop(t *testing.T) {
+	teh := &countingTimedEventHandler{release: make(chan struct{})}
+	close(teh.release)
+	tp := NewTimedPlugin(time.Millisecond)
+	tp.SetEventHandler(teh)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if (i+j)%2 == 0 {
+					tp.start()
+				} else {
+					tp.stop()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	tp.stop()
+}
+
+type panickingEventHandler struct{}
+
+func (eh *panickingEventHandler) HandleEvent(m *Message, args []string) {
+	panic("oops")
+}
+
+// TestPluginPanic tests that a panicking plugin is recovered, reported to the
+// OnError hooks, and disabled after PluginMaxPanics panics in a row.
+func TestPluginPanic(t *testing.T) {
+	b := initBot()
+	b.Config.PluginMaxPanics = 2
+	errs := make(chan error, 2)
+	b.OnError(func(err error) { errs <- err })
+
+	p := NewPlugin("panic")
+	p.SetEventHandler(&panickingEventHandler{})
+	if err := b.RegisterPlugin(p, "panic"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	for i := 0; i < 2; i++ {
+		b.pluginChatChannelsWrite(p, &Message{Bot: b, Message: ".panic"})
+		select {
+		case err := <-errs:
+			perr, ok := err.(*PanicError)
+			if !ok {
+				t.Fatalf(`err (%T) should be *PanicError`, err)
+			}
+			if perr.Plugin != "panic" || perr.Message != ".panic" || perr.Value != "oops" || len(perr.Stack) == 0 {
+				t.Errorf(`perr (%v) should be the panic of plugin panic`, perr)
+			}
+		case <-time.After(time.Second):
+			t.Fatal(`the panic should have been reported`)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if n := p.Failures(); n != 2 {
+		t.Errorf(`p.Failures() (%d) should == 2`, n)
+	}
+	if !p.Disabled() {
+		t.Fatal(`p.Disabled() should == true`)
+	}
+	if p.accepts(&Message{Bot: b, Message: ".panic"}) {
+		t.Error(`a disabled plugin should not accept messages`)
+	}
+
+	p.Enable()
+	if p.Disabled() {
+		t.Error(`p.Disabled() should == false after p.Enable()`)
+	}
+}
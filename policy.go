@@ -0,0 +1,312 @@
+package sdbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RoleTrusted is the role of the users the owners of the bot trust. The bot
+// gives it no meaning of its own; list it as "role:trusted" in a
+// PluginWhitelists entry to let trusted users use a plugin.
+const RoleTrusted = "trusted"
+
+// Policy holds the roles of the bot, which are granted to users on top of
+// their Showdown ranks, and the rules that decide who can use which plugin.
+// Users with the BotOwner role are owners of the bot just like the Owners of
+// the Config.
+//
+// The roles are read from the Roles of the Config, and changed at runtime
+// with Grant and Revoke. If the Config sets a PolicyFile, every change is
+// saved to it, and the roles saved there replace those of the Config when the
+// bot starts. The whitelists and blacklists are read from the Config only.
+type Policy struct {
+	mutex      sync.RWMutex
+	file       string
+	roles      map[string][]string
+	whitelists map[string][]string
+	blacklists map[string][]string
+}
+
+// The part of the Policy that is saved to the PolicyFile.
+type policyState struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+// Creates the Policy described by the Config, with the roles of its
+// PolicyFile if it has one.
+func newPolicy(config *Config) (*Policy, error) {
+	po := &Policy{
+		file:       config.PolicyFile,
+		roles:      make(map[string][]string),
+		whitelists: make(map[string][]string),
+		blacklists: make(map[string][]string),
+	}
+	for role, users := range config.Roles {
+		for _, user := range users {
+			addName(po.roles, roleID(role), Sanitize(user))
+		}
+	}
+	for plugin, names := range config.PluginWhitelists {
+		for _, name := range names {
+			addName(po.whitelists, plugin, nameID(name))
+		}
+	}
+	for room, names := range config.RoomBlacklists {
+		if room != AllRooms {
+			room = SanitizeRoomid(room)
+		}
+		for _, name := range names {
+			addName(po.blacklists, room, nameID(name))
+		}
+	}
+
+	if po.file == "" {
+		return po, nil
+	}
+	data, err := ioutil.ReadFile(po.file)
+	if os.IsNotExist(err) {
+		return po, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sdbot: could not read policy file: %w", err)
+	}
+	var state policyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("sdbot: could not decode policy file: %w", err)
+	}
+	po.roles = make(map[string][]string)
+	for role, users := range state.Roles {
+		for _, user := range users {
+			addName(po.roles, roleID(role), Sanitize(user))
+		}
+	}
+	return po, nil
+}
+
+// AllRooms is the key of the RoomBlacklists entry that applies to every room
+// and to private messages.
+const AllRooms = "*"
+
+// Roles are named like users. In the lists of names of the whitelists and
+// blacklists, roles are written with rolePrefix so that a user cannot pass
+// for a role by taking its name.
+func roleID(role string) string {
+	return Sanitize(role)
+}
+
+// The prefix of the roles in the lists of names of the Policy.
+const rolePrefix = "role:"
+
+// Returns the id of a user, or of a role if the name starts with rolePrefix,
+// in a list of names of the Policy.
+func nameID(name string) string {
+	name = strings.TrimSpace(name)
+	if len(name) > len(rolePrefix) && strings.EqualFold(name[:len(rolePrefix)], rolePrefix) {
+		return rolePrefix + roleID(name[len(rolePrefix):])
+	}
+	return Sanitize(name)
+}
+
+// Adds a name to the list under the key. Returns false if it was already
+// there.
+func addName(m map[string][]string, key string, id string) bool {
+	if id == "" || includes(m[key], id) {
+		return false
+	}
+	m[key] = append(m[key], id)
+	return true
+}
+
+// HasRole returns true if the user has the role.
+func (po *Policy) HasRole(user string, role string) bool {
+	po.mutex.RLock()
+	defer po.mutex.RUnlock()
+
+	return includes(po.roles[roleID(role)], Sanitize(user))
+}
+
+// Roles returns the roles of the user, sorted by name.
+func (po *Policy) Roles(user string) []string {
+	po.mutex.RLock()
+	defer po.mutex.RUnlock()
+
+	id := Sanitize(user)
+	var roles []string
+	for role, users := range po.roles {
+		if includes(users, id) {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Grant gives the user a role and saves the roles to the PolicyFile. Returns
+// false if the user already had the role.
+func (po *Policy) Grant(user string, role string) (bool, error) {
+	po.mutex.Lock()
+	defer po.mutex.Unlock()
+
+	if !addName(po.roles, roleID(role), Sanitize(user)) {
+		return false, nil
+	}
+	return true, po.save()
+}
+
+// Revoke takes a role from the user and saves the roles to the PolicyFile.
+// Returns false if the user did not have the role.
+func (po *Policy) Revoke(user string, role string) (bool, error) {
+	po.mutex.Lock()
+	defer po.mutex.Unlock()
+
+	role, id := roleID(role), Sanitize(user)
+	users := po.roles[role]
+	for i, u := range users {
+		if u == id {
+			po.roles[role] = append(users[:i:i], users[i+1:]...)
+			if len(po.roles[role]) == 0 {
+				delete(po.roles, role)
+			}
+			return true, po.save()
+		}
+	}
+	return false, nil
+}
+
+// Returns true if the name is the user or one of their roles.
+func (po *Policy) matches(names []string, id string) bool {
+	for _, name := range names {
+		if role := strings.TrimPrefix(name, rolePrefix); role != name {
+			if includes(po.roles[role], id) {
+				return true
+			}
+		} else if name == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns accessIgnored if the user is blacklisted in the room, and
+// accessDenied if the plugin has a whitelist that does not list the user or
+// one of their roles.
+func (po *Policy) check(id string, plugin string, room string) access {
+	po.mutex.RLock()
+	defer po.mutex.RUnlock()
+
+	if po.matches(po.blacklists[AllRooms], id) {
+		return accessIgnored
+	}
+	if room != "" && po.matches(po.blacklists[SanitizeRoomid(room)], id) {
+		return accessIgnored
+	}
+	if whitelist, ok := po.whitelists[plugin]; ok && !po.matches(whitelist, id) {
+		return accessDenied
+	}
+	return accessAllowed
+}
+
+// Writes the roles to the PolicyFile, through a temporary file so that a
+// crash cannot leave it half written. Does nothing if there is no PolicyFile.
+// The mutex must be held.
+func (po *Policy) save() error {
+	if po.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(policyState{Roles: po.roles}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("sdbot: could not encode policy file: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(po.file), ".policy")
+	if err != nil {
+		return fmt.Errorf("sdbot: could not save policy file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), po.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("sdbot: could not save policy file: %w", err)
+	}
+	return nil
+}
+
+// Can returns true if the user may use the plugin named action in the room,
+// which is empty for private messages. Owners of the bot can do anything.
+// Otherwise users blacklisted in the room can do nothing there, and a plugin
+// with a whitelist can only be used by the users and roles it lists. Plugins
+// ignore the messages of blacklisted users without replying.
+func (b *Bot) Can(u *User, action string, room string) bool {
+	if u == nil {
+		return false
+	}
+	if b.IsOwner(u) {
+		return true
+	}
+	return b.Policy.check(Sanitize(u.Name), action, room) == accessAllowed
+}
+
+// RegisterPolicyCommands registers the plugins with which the owners of the
+// bot manage roles from the chat: "grant user, role", "revoke user, role" and
+// "roles user".
+func (b *Bot) RegisterPolicyCommands() error {
+	grant := NewPluginWithArgs("grant", 2)
+	grant.RequireAuth(BotOwner)
+	grant.SetHandler(func(c *Context) error {
+		user, role := c.Arg(0), c.Arg(1)
+		ok, err := c.Bot.Policy.Grant(user, role)
+		switch {
+		case err != nil:
+			return err
+		case ok:
+			c.Replyf("%s is now %s.", user, roleID(role))
+		default:
+			c.Replyf("%s is already %s.", user, roleID(role))
+		}
+		return nil
+	})
+
+	revoke := NewPluginWithArgs("revoke", 2)
+	revoke.RequireAuth(BotOwner)
+	revoke.SetHandler(func(c *Context) error {
+		user, role := c.Arg(0), c.Arg(1)
+		ok, err := c.Bot.Policy.Revoke(user, role)
+		switch {
+		case err != nil:
+			return err
+		case ok:
+			c.Replyf("%s is no longer %s.", user, roleID(role))
+		default:
+			c.Replyf("%s is not %s.", user, roleID(role))
+		}
+		return nil
+	})
+
+	roles := NewPluginWithArgs("roles", 1)
+	roles.RequireAuth(BotOwner)
+	roles.SetHandler(func(c *Context) error {
+		user := c.Arg(0)
+		if r := c.Bot.Policy.Roles(user); len(r) > 0 {
+			c.Replyf("%s is %s.", user, strings.Join(r, ", "))
+		} else {
+			c.Replyf("%s has no roles.", user)
+		}
+		return nil
+	})
+
+	return b.RegisterPlugins(map[string]*Plugin{
+		"grant":  grant,
+		"revoke": revoke,
+		"roles":  roles,
+	})
+}
@@ -0,0 +1,115 @@
+package sdbot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCan tests the whitelists and blacklists of the policy, and that owners
+// are allowed everything.
+func TestCan(t *testing.T) {
+	b := initBot()
+	b.Config.Roles = map[string][]string{"owner": {"Boss"}, "trusted": {"Friend"}}
+	b.Config.PluginWhitelists = map[string][]string{"echo": {"role:trusted", "Guest"}}
+	b.Config.RoomBlacklists = map[string][]string{"Lobby": {"Friend"}, "*": {"Troll"}}
+	policy, err := newPolicy(b.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Policy = policy
+
+	tests := []struct {
+		user     string
+		action   string
+		room     string
+		expected bool
+	}{
+		{"Friend", "echo", "", true},
+		{"Guest", "echo", "testroom", true},
+		{"Stranger", "echo", "testroom", false},
+		{"Stranger", "hello", "testroom", true},
+		{"Friend", "hello", "lobby", false},
+		{"Troll", "hello", "", false},
+		{"Boss", "echo", "lobby", true},
+	}
+	for _, test := range tests {
+		if ok := b.Can(NewUser(test.user), test.action, test.room); ok != test.expected {
+			t.Errorf(`b.Can(%s, %s, %q) (%v) should == %v`, test.user, test.action, test.room, ok, test.expected)
+		}
+	}
+
+	if b.Can(NewUser("Trusted"), "echo", "") {
+		t.Error(`a user named like a role should not pass for it`)
+	}
+
+	if !b.IsOwner(NewUser("boss")) {
+		t.Error(`users with the owner role should be owners`)
+	}
+}
+
+// TestPolicyFile tests that granted and revoked roles are saved to the policy
+// file and read back from it.
+func TestPolicyFile(t *testing.T) {
+	config := &Config{
+		PolicyFile: filepath.Join(t.TempDir(), "policy.json"),
+		Roles:      map[string][]string{"trusted": {"Friend"}},
+	}
+	po, err := newPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := po.Grant("Tympy", "Trusted"); !ok || err != nil {
+		t.Fatalf(`po.Grant (%v, %v) should == true, nil`, ok, err)
+	}
+	if ok, _ := po.Grant("tympy", "trusted"); ok {
+		t.Error(`granting a role twice should return false`)
+	}
+	if ok, err := po.Revoke("Friend", "trusted"); !ok || err != nil {
+		t.Fatalf(`po.Revoke (%v, %v) should == true, nil`, ok, err)
+	}
+	if _, err := os.Stat(config.PolicyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	po, err = newPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !po.HasRole("Tympy", "trusted") || po.HasRole("Friend", "trusted") {
+		t.Errorf(`po.Roles (%v) should only make Tympy trusted`, po.roles)
+	}
+}
+
+// TestPolicyDeny tests that users refused by a whitelist are replied to with
+// the denial reply, and that blacklisted users are ignored without one.
+func TestPolicyDeny(t *testing.T) {
+	b := initBot()
+	b.Config.PluginWhitelists = map[string][]string{"secret": {"Friend"}}
+	b.Config.RoomBlacklists = map[string][]string{"*": {"Troll"}}
+	policy, err := newPolicy(b.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Policy = policy
+
+	p := NewPlugin("secret")
+	p.DenialReply = "nope"
+	if err := b.RegisterPlugin(p, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer b.UnregisterPlugin(p)
+
+	st := &stubTarget{}
+	onChat(&Message{Bot: b, Kind: KindChat, User: NewUser("Stranger"), Auth: Unvoiced, Target: st, Message: ".secret"})
+	if len(st.replies) != 1 || st.replies[0] != "nope" {
+		t.Errorf(`st.replies (%q) should == ["nope"]`, st.replies)
+	}
+
+	st = &stubTarget{}
+	onChat(&Message{Bot: b, Kind: KindChat, User: NewUser("Troll"), Auth: Unvoiced, Target: st, Message: ".secret"})
+	if len(st.replies) != 0 {
+		t.Errorf(`st.replies (%q) should be empty`, st.replies)
+	}
+}
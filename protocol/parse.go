@@ -0,0 +1,220 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrMalformed is returned when a line is missing parts that its type
+// requires, or has parts that cannot be decoded.
+var ErrMalformed = errors.New("sdbot/protocol: malformed message")
+
+// The battle lines that are parsed as *Battle. Lines starting with "-", which
+// are the minor actions of a battle, are parsed as *Battle as well.
+var battleTypes = map[string]bool{
+	"player": true, "teamsize": true, "gametype": true, "gen": true,
+	"tier": true, "rated": true, "rule": true, "clearpoke": true,
+	"poke": true, "teampreview": true, "start": true, "request": true,
+	"inactive": true, "inactiveoff": true, "upkeep": true, "turn": true,
+	"tie": true, "move": true, "switch": true, "drag": true,
+	"detailschange": true, "replace": true, "swap": true, "cant": true,
+	"faint": true,
+}
+
+// Parse parses a line sent by the server to the given room. The room is the
+// name after the > on the first line of the frame, or empty if the frame had
+// none. Returns an error wrapping ErrMalformed if the line is of a known type
+// but cannot be parsed. Parse never panics.
+func Parse(room string, line string) (Message, error) {
+	l := Line{Room: room, Raw: line}
+	if !strings.HasPrefix(line, "|") {
+		return &Text{Line: l, Text: line}, nil
+	}
+
+	parts := strings.Split(line[1:], "|")
+	l.Type, parts = parts[0], parts[1:]
+	rest := func(i int) string {
+		if i >= len(parts) {
+			return ""
+		}
+		return strings.Join(parts[i:], "|")
+	}
+	malformed := func(reason string) error {
+		return fmt.Errorf("%w: %s: %q", ErrMalformed, reason, line)
+	}
+
+	switch t := strings.ToLower(l.Type); t {
+	case "c:":
+		if len(parts) < 3 {
+			return nil, malformed("missing timestamp, user or message")
+		}
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, malformed("invalid timestamp")
+		}
+		return &Chat{Line: l, Timestamp: ts, User: ParseUser(parts[1]), Message: rest(2)}, nil
+	case "c", "chat":
+		if len(parts) < 2 {
+			return nil, malformed("missing user or message")
+		}
+		return &Chat{Line: l, User: ParseUser(parts[0]), Message: rest(1)}, nil
+	case "pm":
+		if len(parts) < 3 {
+			return nil, malformed("missing sender, recipient or message")
+		}
+		return &PM{Line: l, From: ParseUser(parts[0]), To: ParseUser(parts[1]), Message: rest(2)}, nil
+	case "j", "join":
+		if len(parts) < 1 || parts[0] == "" {
+			return nil, malformed("missing user")
+		}
+		return &Join{Line: l, User: ParseUser(parts[0])}, nil
+	case "l", "leave":
+		if len(parts) < 1 || parts[0] == "" {
+			return nil, malformed("missing user")
+		}
+		return &Leave{Line: l, User: ParseUser(parts[0])}, nil
+	case "n", "name":
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, malformed("missing user or old name")
+		}
+		return &Name{Line: l, User: ParseUser(parts[0]), OldID: parts[1]}, nil
+	case ":":
+		if len(parts) < 1 {
+			return nil, malformed("missing timestamp")
+		}
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, malformed("invalid timestamp")
+		}
+		return &Timestamp{Line: l, Timestamp: ts}, nil
+	case "init":
+		return &Init{Line: l, RoomType: rest(0)}, nil
+	case "deinit":
+		return &Deinit{Line: l}, nil
+	case "title":
+		return &Title{Line: l, Title: rest(0)}, nil
+	case "users":
+		return parseUsers(l, rest(0))
+	case "raw":
+		return &Raw{Line: l, HTML: rest(0)}, nil
+	case "html":
+		return &HTML{Line: l, HTML: rest(0)}, nil
+	case "uhtml", "uhtmlchange":
+		if len(parts) < 1 {
+			return nil, malformed("missing name")
+		}
+		return &UHTML{Line: l, Name: parts[0], HTML: rest(1), Change: t == "uhtmlchange"}, nil
+	case "popup":
+		// The server sends newlines in popups as ||.
+		return &Popup{Line: l, Message: strings.Replace(rest(0), "||", "\n", -1)}, nil
+	case "error":
+		return &Error{Line: l, Message: rest(0)}, nil
+	case "queryresponse":
+		if len(parts) < 2 {
+			return nil, malformed("missing query or response")
+		}
+		return &QueryResponse{Line: l, Query: parts[0], JSON: rest(1)}, nil
+	case "formats":
+		return &Formats{Line: l, Formats: parseFormats(parts)}, nil
+	case "tournament":
+		if len(parts) < 1 {
+			return nil, malformed("missing action")
+		}
+		return &Tournament{Line: l, Action: parts[0], Params: parts[1:]}, nil
+	case "challstr":
+		if len(parts) < 2 {
+			return nil, malformed("missing key id or challenge")
+		}
+		return &Challstr{Line: l, KeyID: parts[0], Challenge: rest(1)}, nil
+	case "updateuser":
+		if len(parts) < 2 {
+			return nil, malformed("missing name or named flag")
+		}
+		u := &UpdateUser{Line: l, Name: strings.TrimLeft(parts[0], " "), Named: parts[1] == "1"}
+		if len(parts) > 2 {
+			u.Avatar = parts[2]
+		}
+		return u, nil
+	case "nametaken":
+		if len(parts) < 1 {
+			return nil, malformed("missing name")
+		}
+		return &NameTaken{Line: l, Name: parts[0], Message: rest(1)}, nil
+	case "win":
+		return &Win{Line: l, User: rest(0)}, nil
+	default:
+		if battleTypes[t] || strings.HasPrefix(t, "-") {
+			return &Battle{Line: l, Action: l.Type, Params: parts}, nil
+		}
+		return &Unknown{Line: l, Params: parts}, nil
+	}
+}
+
+// ParseUser parses a user as the server names them in messages: their rank,
+// followed by their name and optionally an @ and their status. A status
+// starting with ! means the user is away.
+func ParseUser(s string) User {
+	if s == "" {
+		return User{}
+	}
+
+	r, size := utf8.DecodeRuneInString(s)
+	u := User{Rank: string(r), Name: s[size:]}
+	if i := strings.Index(u.Name, "@"); i >= 0 {
+		u.Name, u.Status = u.Name[:i], u.Name[i+1:]
+		if strings.HasPrefix(u.Status, "!") {
+			u.Away = true
+			u.Status = u.Status[1:]
+		}
+	}
+	return u
+}
+
+// Parses a user list such as "3,@Mod,+Voice, Guest", which starts with the
+// number of users.
+func parseUsers(l Line, list string) (Message, error) {
+	entries := strings.Split(list, ",")
+	count, err := strconv.Atoi(strings.TrimSpace(entries[0]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid user count: %q", ErrMalformed, l.Raw)
+	}
+
+	users := &Users{Line: l, Count: count}
+	for _, e := range entries[1:] {
+		if e == "" {
+			continue
+		}
+		users.Users = append(users.Users, ParseUser(e))
+	}
+	return users, nil
+}
+
+// Parses the list of formats. A comma followed by the number of a column
+// starts a new section, whose name is the part after it, and the flags of a
+// format follow its name after a comma. Other parts starting with a comma are
+// flags of the whole list.
+func parseFormats(parts []string) []Format {
+	var formats []Format
+	var section string
+	for i := 0; i < len(parts); i++ {
+		p := parts[i]
+		if strings.HasPrefix(p, ",") {
+			if _, err := strconv.Atoi(p[1:]); err == nil && i+1 < len(parts) {
+				section = parts[i+1]
+				i++
+			}
+			continue
+		}
+		if j := strings.Index(p, ","); j >= 0 {
+			p = p[:j]
+		}
+		if p == "" {
+			continue
+		}
+		formats = append(formats, Format{Name: p, Section: section})
+	}
+	return formats
+}
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestParseChat tests that chat messages are parsed with their timestamp,
+// user and message, and that a | in the message is kept.
+func TestParseChat(t *testing.T) {
+	msg, err := Parse("testroom", "|c:|100|+Mystifi@!busy|ayy|lmao")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, ok := msg.(*Chat)
+	if !ok {
+		t.Fatalf(`msg (%T) should be *Chat`, msg)
+	}
+	if c.Room != "testroom" || c.Type != "c:" {
+		t.Errorf(`c.Room, c.Type (%s, %s) should == testroom, c:`, c.Room, c.Type)
+	}
+	if c.Timestamp != 100 {
+		t.Errorf(`c.Timestamp (%d) should == 100`, c.Timestamp)
+	}
+	if c.User.Rank != "+" || c.User.Name != "Mystifi" || !c.User.Away || c.User.Status != "busy" {
+		t.Errorf(`c.User (%+v) should be the away voice Mystifi`, c.User)
+	}
+	if c.Message != "ayy|lmao" {
+		t.Errorf(`c.Message (%s) should == "ayy|lmao"`, c.Message)
+	}
+}
+
+// TestParseTypes tests that lines are parsed into the right types.
+func TestParseTypes(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Message
+	}{
+		{"hello", &Text{}},
+		{"|pm| Tympy|*Bot|hi", &PM{}},
+		{"|J|★Tympy", &Join{}},
+		{"|l|@Tympy", &Leave{}},
+		{"|N|+Tympani|tympy", &Name{}},
+		{"|:|1500000000", &Timestamp{}},
+		{"|init|chat", &Init{}},
+		{"|title|Test Room", &Title{}},
+		{"|users|2,@Mod, Guest", &Users{}},
+		{"|uhtmlchange|poll|<b>hi</b>", &UHTML{}},
+		{"|popup|line one||line two", &Popup{}},
+		{"|queryresponse|roomlist|{}", &QueryResponse{}},
+		{"|formats|,1|Singles|[Gen 7] OU,e", &Formats{}},
+		{"|tournament|create|gen7ou", &Tournament{}},
+		{"|challstr|4|abc", &Challstr{}},
+		{"|updateuser| Bot|1|170", &UpdateUser{}},
+		{"|-damage|p1a: Pikachu|50/100", &Battle{}},
+		{"|win|Tympy", &Win{}},
+		{"|somethingnew|a|b", &Unknown{}},
+	}
+
+	for _, test := range tests {
+		msg, err := Parse("", test.line)
+		if err != nil {
+			t.Errorf(`Parse(%q) returned %v`, test.line, err)
+			continue
+		}
+		if got, want := fmt.Sprintf("%T", msg), fmt.Sprintf("%T", test.expected); got != want {
+			t.Errorf(`Parse(%q) (%s) should be %s`, test.line, got, want)
+		}
+	}
+}
+
+// TestParseDetails tests the fields of the types that are parsed from lists.
+func TestParseDetails(t *testing.T) {
+	msg, _ := Parse("", "|users|3,@Mod,★Battler")
+	users := msg.(*Users)
+	if users.Count != 3 || len(users.Users) != 2 {
+		t.Fatalf(`users (%+v) should count 3 and list 2`, users)
+	}
+	if users.Users[1].Rank != "★" || users.Users[1].Name != "Battler" {
+		t.Errorf(`users.Users[1] (%+v) should be ★Battler`, users.Users[1])
+	}
+
+	msg, _ = Parse("", "|formats|,LL|,1|S/M Singles|[Gen 7] Random Battle,f|[Gen 7] OU,e")
+	formats := msg.(*Formats).Formats
+	if len(formats) != 2 || formats[1].Name != "[Gen 7] OU" || formats[1].Section != "S/M Singles" {
+		t.Errorf(`formats (%+v) should list two S/M Singles formats`, formats)
+	}
+
+	msg, _ = Parse("", "|popup|line one||line two")
+	if p := msg.(*Popup); p.Message != "line one\nline two" {
+		t.Errorf(`p.Message (%q) should == "line one\nline two"`, p.Message)
+	}
+}
+
+// TestParseMalformed tests that malformed lines return ErrMalformed instead of
+// panicking.
+func TestParseMalformed(t *testing.T) {
+	lines := []string{
+		"|c:",
+		"|c:|notanumber|+User|hi",
+		"|c:|100",
+		"|pm|+User",
+		"|j|",
+		"|n|+User",
+		"|users|",
+		"|challstr|4",
+		"|updateuser|",
+		"|:|",
+	}
+	for _, line := range lines {
+		msg, err := Parse("", line)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf(`Parse(%q) (%v, %v) should return ErrMalformed`, line, msg, err)
+		}
+	}
+}
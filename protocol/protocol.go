@@ -0,0 +1,226 @@
+// Package protocol models the messages a Pokemon Showdown server sends. Every
+// line the server sends is parsed into one of the message types below, which
+// can be told apart with a type switch:
+//
+//	switch msg := parsed.(type) {
+//	case *protocol.Chat:
+//		fmt.Println(msg.User.Name, "said", msg.Message)
+//	case *protocol.Join:
+//		fmt.Println(msg.User.Name, "joined", msg.Room)
+//	}
+//
+// Lines the parser does not know are returned as *Unknown, and lines that do
+// not start with a | are returned as *Text.
+package protocol
+
+// Message is a message sent by the server.
+type Message interface {
+	// Header returns the parts that every message has.
+	Header() *Line
+}
+
+// Line holds the parts that every message has: the room it was sent to, which
+// is empty for global messages, the type of the message as sent by the server,
+// such as "c:" or "J", and the raw line.
+type Line struct {
+	Room string
+	Type string
+	Raw  string
+}
+
+// Header returns the Line.
+func (l *Line) Header() *Line {
+	return l
+}
+
+// User is a user as the server names them in messages, with their rank in the
+// room and their status.
+type User struct {
+	Rank   string
+	Name   string
+	Status string
+	Away   bool
+}
+
+// Text is a line that does not start with a |, which the server shows as it
+// is in the room.
+type Text struct {
+	Line
+	Text string
+}
+
+// Chat is a chat message in a room. The Timestamp is zero for messages sent
+// as "c" rather than "c:".
+type Chat struct {
+	Line
+	Timestamp int64
+	User      User
+	Message   string
+}
+
+// PM is a private message.
+type PM struct {
+	Line
+	From    User
+	To      User
+	Message string
+}
+
+// Join is sent when a user joins a room.
+type Join struct {
+	Line
+	User User
+}
+
+// Leave is sent when a user leaves a room.
+type Leave struct {
+	Line
+	User User
+}
+
+// Name is sent when a user in a room changes their name. OldID is the
+// sanitized name they had before.
+type Name struct {
+	Line
+	User  User
+	OldID string
+}
+
+// Timestamp is sent when the bot joins a room, with the server time at which
+// it joined.
+type Timestamp struct {
+	Line
+	Timestamp int64
+}
+
+// Init is sent when the bot joins a room. RoomType is either "chat" or
+// "battle".
+type Init struct {
+	Line
+	RoomType string
+}
+
+// Deinit is sent when the bot leaves a room.
+type Deinit struct {
+	Line
+}
+
+// Title is the title of a room.
+type Title struct {
+	Line
+	Title string
+}
+
+// Users is the list of users in a room. Count is the number of users the
+// server counts, which includes guests that are not listed.
+type Users struct {
+	Line
+	Count int
+	Users []User
+}
+
+// Raw is HTML that the server shows in the room.
+type Raw struct {
+	Line
+	HTML string
+}
+
+// HTML is HTML that the server shows in the room, such as an /addhtmlbox.
+type HTML struct {
+	Line
+	HTML string
+}
+
+// UHTML is HTML with a name, which the server may later replace. Change is set
+// for "uhtmlchange", which replaces the HTML of that name where it is instead
+// of showing it again.
+type UHTML struct {
+	Line
+	Name   string
+	HTML   string
+	Change bool
+}
+
+// Popup is a message shown to the bot in a popup.
+type Popup struct {
+	Line
+	Message string
+}
+
+// Error is an error the server sent, such as for a command the bot may not
+// use.
+type Error struct {
+	Line
+	Message string
+}
+
+// QueryResponse is the answer to a /query. JSON is the undecoded answer.
+type QueryResponse struct {
+	Line
+	Query string
+	JSON  string
+}
+
+// Format is a battle format, along with the name of the section it is listed
+// in.
+type Format struct {
+	Name    string
+	Section string
+}
+
+// Formats is the list of battle formats of the server.
+type Formats struct {
+	Line
+	Formats []Format
+}
+
+// Tournament is an update about the tournament in a room. Action is the kind
+// of update, such as "create" or "end", and Params are its parameters.
+type Tournament struct {
+	Line
+	Action string
+	Params []string
+}
+
+// Challstr is the challenge the bot needs to log in.
+type Challstr struct {
+	Line
+	KeyID     string
+	Challenge string
+}
+
+// UpdateUser is sent when the name of the bot changes. Named is set once the
+// bot has logged in.
+type UpdateUser struct {
+	Line
+	Name   string
+	Named  bool
+	Avatar string
+}
+
+// NameTaken is sent when the bot could not take a name.
+type NameTaken struct {
+	Line
+	Name    string
+	Message string
+}
+
+// Win is sent when a battle ends with a winner.
+type Win struct {
+	Line
+	User string
+}
+
+// Battle is any other line of a battle. Action is the type of the line, such
+// as "turn", "move" or "-damage", and Params are its parameters.
+type Battle struct {
+	Line
+	Action string
+	Params []string
+}
+
+// Unknown is a message of a type the parser does not know.
+type Unknown struct {
+	Line
+	Params []string
+}
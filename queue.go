@@ -0,0 +1,321 @@
+package sdbot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority decides the order in which outgoing messages are sent. Messages of
+// a higher priority are sent before any message of a lower priority, and
+// messages of the same priority are sent in the order they were queued.
+type Priority int
+
+// The priorities of outgoing messages. QueueMessage picks PriorityHigh for
+// logging in and moderation commands, PriorityNormal for other commands and
+// PriorityLow for chat.
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	numPriorities
+)
+
+// ErrMessageCancelled is the error of an OutgoingMessage that was cancelled
+// before it was sent.
+var ErrMessageCancelled = errors.New("sdbot: outgoing message was cancelled")
+
+// ErrConnectionClosed is the error of an OutgoingMessage that was still queued
+// when the bot was shut down.
+var ErrConnectionClosed = errors.New("sdbot: connection was closed before the message was sent")
+
+// The states of an OutgoingMessage.
+const (
+	messageQueued = iota
+	messageSending
+	messageSent
+	messageCancelled
+	messageFailed
+)
+
+// OutgoingMessage is a handle to a message in the outgoing queue. It can be
+// used to cancel the message while it is queued, or to find out when it has
+// been written to the socket.
+type OutgoingMessage struct {
+	Text     string
+	Priority Priority
+	room     string
+	outbox   *outbox
+	state    int
+	err      error
+	done     chan struct{}
+}
+
+// Cancel removes the message from the outgoing queue. Returns false if the
+// message has already been sent or cancelled.
+func (om *OutgoingMessage) Cancel() bool {
+	om.outbox.mutex.Lock()
+	defer om.outbox.mutex.Unlock()
+
+	if om.state != messageQueued {
+		return false
+	}
+	om.finish(messageCancelled, ErrMessageCancelled)
+	return true
+}
+
+// Done returns a channel that is closed once the message has been written to
+// the socket, has been cancelled, or could not be sent. Err tells which.
+func (om *OutgoingMessage) Done() <-chan struct{} {
+	return om.done
+}
+
+// Err returns nil once the message has been written to the socket. Returns
+// ErrMessageCancelled if it was cancelled, ErrConnectionClosed if the bot was
+// shut down before it could be sent, or the error writing it to the socket.
+func (om *OutgoingMessage) Err() error {
+	om.outbox.mutex.Lock()
+	defer om.outbox.mutex.Unlock()
+
+	if om.state == messageQueued || om.state == messageSending {
+		return nil
+	}
+	return om.err
+}
+
+// Wait blocks until the message is done or the context expires, and returns
+// the message's Err or the context's error.
+func (om *OutgoingMessage) Wait(ctx context.Context) error {
+	select {
+	case <-om.done:
+		return om.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Marks the message as done. Must be called with the outbox mutex held.
+func (om *OutgoingMessage) finish(state int, err error) {
+	if om.state != messageQueued && om.state != messageSending {
+		return
+	}
+	om.state = state
+	om.err = err
+	close(om.done)
+}
+
+// The commands sent with PriorityHigh by QueueMessage.
+var highPriorityCommands = map[string]bool{
+	"trn": true, "ban": true, "b": true, "roomban": true, "unban": true,
+	"mute": true, "m": true, "hourmute": true, "hm": true, "unmute": true,
+	"lock": true, "l": true, "unlock": true, "warn": true, "k": true,
+	"kick": true, "hidetext": true, "ht": true, "modchat": true,
+	"blacklist": true, "bl": true, "declare": true,
+}
+
+// Picks the priority of an outgoing message by the command it runs, if any.
+func messagePriority(msg string) Priority {
+	i := strings.Index(msg, "|")
+	if i < 0 {
+		return PriorityLow
+	}
+	text := msg[i+1:]
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return PriorityLow
+	}
+
+	cmd := strings.ToLower(strings.TrimPrefix(text, "/"))
+	if j := strings.IndexAny(cmd, " ,"); j >= 0 {
+		cmd = cmd[:j]
+	}
+	if cmd == "w" || cmd == "msg" || cmd == "pm" || cmd == "whisper" {
+		return PriorityLow
+	}
+	if highPriorityCommands[cmd] {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// roomQueues holds the queues of one priority. Every room has its own queue,
+// and the rooms take turns so that a busy room cannot hold up the others.
+type roomQueues struct {
+	queues map[string][]*OutgoingMessage
+	rooms  []string
+	next   int
+}
+
+// outbox holds the outgoing messages until the RateLimiter lets them through.
+// Messages that are not sent to a room share a queue of their own.
+type outbox struct {
+	mutex  sync.Mutex
+	levels [numPriorities]*roomQueues
+	notify chan struct{}
+}
+
+func newOutbox() *outbox {
+	o := &outbox{
+		notify: make(chan struct{}, 1),
+	}
+	for i := range o.levels {
+		o.levels[i] = &roomQueues{queues: make(map[string][]*OutgoingMessage)}
+	}
+	return o
+}
+
+// Adds a message to the queue of its room and priority. Never blocks.
+func (o *outbox) push(msg string, p Priority) *OutgoingMessage {
+	if p < PriorityLow {
+		p = PriorityLow
+	} else if p >= numPriorities {
+		p = numPriorities - 1
+	}
+
+	om := &OutgoingMessage{
+		Text:     msg,
+		Priority: p,
+		room:     outgoingRoom(msg),
+		outbox:   o,
+		done:     make(chan struct{}),
+	}
+
+	o.mutex.Lock()
+	rq := o.levels[p]
+	if len(rq.queues[om.room]) == 0 {
+		rq.rooms = append(rq.rooms, om.room)
+	}
+	rq.queues[om.room] = append(rq.queues[om.room], om)
+	o.mutex.Unlock()
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return om
+}
+
+// Takes the next message the RateLimiter allows to be sent, starting with the
+// highest priority. If no message may be sent yet, returns how long to wait
+// before trying again, or zero if the outbox is empty.
+func (o *outbox) pop(rl *RateLimiter, now time.Time) (*OutgoingMessage, time.Duration) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var wait time.Duration
+	for p := numPriorities - 1; p >= PriorityLow; p-- {
+		om, w := o.levels[p].pop(rl, now)
+		if om != nil {
+			return om, 0
+		}
+		if w > 0 && (wait == 0 || w < wait) {
+			wait = w
+		}
+	}
+	return nil, wait
+}
+
+// Takes the next message of this priority, going round the rooms in turn.
+func (rq *roomQueues) pop(rl *RateLimiter, now time.Time) (*OutgoingMessage, time.Duration) {
+	rq.prune()
+
+	var wait time.Duration
+	for i := 0; i < len(rq.rooms); i++ {
+		idx := (rq.next + i) % len(rq.rooms)
+		room := rq.rooms[idx]
+
+		ok, w := rl.take(room, now)
+		if !ok {
+			if w <= 0 {
+				w = time.Millisecond
+			}
+			if wait == 0 || w < wait {
+				wait = w
+			}
+			continue
+		}
+
+		q := rq.queues[room]
+		q[0].state = messageSending
+		rq.queues[room] = q[1:]
+		if len(q) == 1 {
+			rq.remove(idx)
+		} else {
+			rq.next = (idx + 1) % len(rq.rooms)
+		}
+		return q[0], 0
+	}
+	return nil, wait
+}
+
+// Drops cancelled messages from the front of the queues, and the rooms that
+// are left without messages.
+func (rq *roomQueues) prune() {
+	rooms := rq.rooms[:0]
+	next := rq.next
+	for i, room := range rq.rooms {
+		q := rq.queues[room]
+		for len(q) > 0 && q[0].state != messageQueued {
+			q = q[1:]
+		}
+		if len(q) == 0 {
+			delete(rq.queues, room)
+			if i < rq.next {
+				next--
+			}
+			continue
+		}
+		rq.queues[room] = q
+		rooms = append(rooms, room)
+	}
+
+	rq.rooms = rooms
+	if len(rooms) > 0 {
+		rq.next = next % len(rooms)
+	} else {
+		rq.next = 0
+	}
+}
+
+// Removes the room at idx from the turns, passing the turn to the room after
+// it.
+func (rq *roomQueues) remove(idx int) {
+	delete(rq.queues, rq.rooms[idx])
+	rq.rooms = append(rq.rooms[:idx], rq.rooms[idx+1:]...)
+	rq.next = idx
+	if len(rq.rooms) > 0 {
+		rq.next %= len(rq.rooms)
+	} else {
+		rq.next = 0
+	}
+}
+
+// Marks a message that was popped as sent, or as failed if err is not nil.
+func (o *outbox) sent(om *OutgoingMessage, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if err != nil {
+		om.finish(messageFailed, err)
+		return
+	}
+	om.finish(messageSent, nil)
+}
+
+// Empties the outbox, finishing every queued message with the error.
+func (o *outbox) clear(err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, rq := range o.levels {
+		for _, q := range rq.queues {
+			for _, om := range q {
+				om.finish(messageFailed, err)
+			}
+		}
+		rq.queues = make(map[string][]*OutgoingMessage)
+		rq.rooms = nil
+		rq.next = 0
+	}
+}
@@ -0,0 +1,110 @@
+package sdbot
+
+import (
+	"testing"
+	"time"
+)
+
+func unlimited() *RateLimiter {
+	return &RateLimiter{
+		Room:    NewTokenBucket(1, 100),
+		Private: NewTokenBucket(1, 100),
+		factor:  1,
+	}
+}
+
+// TestOutboxRoundRobin tests that rooms take turns sending their messages, and
+// that the messages of each room are sent in order.
+func TestOutboxRoundRobin(t *testing.T) {
+	rl := unlimited()
+	o := newOutbox()
+	o.push("a|1", PriorityLow)
+	o.push("a|2", PriorityLow)
+	o.push("a|3", PriorityLow)
+	o.push("b|1", PriorityLow)
+	o.push("|/w user,1", PriorityLow)
+
+	expected := []string{"a|1", "b|1", "|/w user,1", "a|2", "a|3"}
+	for _, e := range expected {
+		om, _ := o.pop(rl, time.Now())
+		if om == nil {
+			t.Fatalf(`pop should return %s`, e)
+		}
+		if om.Text != e {
+			t.Errorf(`om.Text (%s) should == %s`, om.Text, e)
+		}
+	}
+
+	if om, wait := o.pop(rl, time.Now()); om != nil || wait != 0 {
+		t.Error(`pop should find the outbox empty`)
+	}
+}
+
+// TestOutboxPriority tests that messages of a higher priority are sent first,
+// and that cancelled messages are not sent.
+func TestOutboxPriority(t *testing.T) {
+	rl := unlimited()
+	o := newOutbox()
+	o.push("a|chatter", messagePriority("a|chatter"))
+	cancelled := o.push("a|/join b", messagePriority("a|/join b"))
+	o.push("a|/ban spammer", messagePriority("a|/ban spammer"))
+	o.push("a|/roomvoice friend", messagePriority("a|/roomvoice friend"))
+
+	if !cancelled.Cancel() {
+		t.Error(`Cancel should cancel a queued message`)
+	}
+	if cancelled.Cancel() {
+		t.Error(`Cancel should not cancel a message twice`)
+	}
+	select {
+	case <-cancelled.Done():
+	default:
+		t.Error(`Done should be closed once the message is cancelled`)
+	}
+	if cancelled.Err() != ErrMessageCancelled {
+		t.Errorf(`cancelled.Err() (%v) should == ErrMessageCancelled`, cancelled.Err())
+	}
+
+	expected := []string{"a|/ban spammer", "a|/roomvoice friend", "a|chatter"}
+	for _, e := range expected {
+		om, _ := o.pop(rl, time.Now())
+		if om == nil {
+			t.Fatalf(`pop should return %s`, e)
+		}
+		if om.Text != e {
+			t.Errorf(`om.Text (%s) should == %s`, om.Text, e)
+		}
+	}
+	if om, _ := o.pop(rl, time.Now()); om != nil {
+		t.Errorf(`pop should not return the cancelled message (%s)`, om.Text)
+	}
+}
+
+// TestOutboxReceipt tests that a message's receipt fires once it is sent, and
+// that messages left over are finished when the outbox is cleared.
+func TestOutboxReceipt(t *testing.T) {
+	rl := unlimited()
+	o := newOutbox()
+	sent := o.push("a|hi", PriorityLow)
+	left := o.push("a|bye", PriorityLow)
+
+	om, _ := o.pop(rl, time.Now())
+	if om.Cancel() {
+		t.Error(`Cancel should not cancel a message that is being sent`)
+	}
+	o.sent(om, nil)
+
+	select {
+	case <-sent.Done():
+	default:
+		t.Fatal(`Done should be closed once the message is sent`)
+	}
+	if sent.Err() != nil {
+		t.Errorf(`sent.Err() (%v) should == nil`, sent.Err())
+	}
+
+	o.clear(ErrConnectionClosed)
+	if left.Err() != ErrConnectionClosed {
+		t.Errorf(`left.Err() (%v) should == ErrConnectionClosed`, left.Err())
+	}
+}
@@ -0,0 +1,125 @@
+package sdbot
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows Burst messages to be sent at once, after which messages
+// may be sent at Rate messages per second. Every message takes a token, and
+// tokens refill at Rate per second up to Burst.
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full TokenBucket.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		Rate:   rate,
+		Burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Refills the bucket for the time passed since the last refill. The rate is
+// scaled by the given factor.
+func (tb *TokenBucket) refill(now time.Time, factor float64) {
+	if !tb.last.IsZero() && now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.Rate * factor
+		if tb.tokens > tb.Burst {
+			tb.tokens = tb.Burst
+		}
+	}
+	tb.last = now
+}
+
+// Takes a token if there is one. Otherwise returns how long to wait until
+// there will be one.
+func (tb *TokenBucket) take(now time.Time, factor float64) (bool, time.Duration) {
+	tb.refill(now, factor)
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	rate := tb.Rate * factor
+	if rate <= 0 {
+		return false, time.Second
+	}
+	return false, time.Duration((1 - tb.tokens) / rate * float64(time.Second))
+}
+
+// The line the server sends when it drops a message because the bot sent it
+// too quickly.
+const throttleNotice = "typing too quickly"
+
+// RateLimiter decides when outgoing messages may be sent. Messages to rooms
+// and private messages (as well as other commands that are not sent to a room)
+// have separate budgets. Whenever the server reports that a message was
+// dropped for being sent too quickly, both budgets are halved, down to an
+// eighth, until ThrottleCooldown passes without another report.
+type RateLimiter struct {
+	Room             *TokenBucket
+	Private          *TokenBucket
+	ThrottleCooldown time.Duration
+	mutex            sync.Mutex
+	factor           float64
+	throttledUntil   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter from the rates and bursts in the
+// Config.
+func NewRateLimiter(c *Config) *RateLimiter {
+	return &RateLimiter{
+		Room:             NewTokenBucket(c.MessagesPerSecond, c.MessageBurst),
+		Private:          NewTokenBucket(c.PrivateMessagesPerSecond, c.PrivateMessageBurst),
+		ThrottleCooldown: time.Duration(c.ThrottleCooldown * float64(time.Second)),
+		factor:           1,
+	}
+}
+
+// Takes a token from the budget of the given room. An empty room stands for
+// private messages and other commands.
+func (rl *RateLimiter) take(room string, now time.Time) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.factor < 1 && now.After(rl.throttledUntil) {
+		Info("Outgoing message rate restored.")
+		rl.factor = 1
+	}
+
+	if room == "" {
+		return rl.Private.take(now, rl.factor)
+	}
+	return rl.Room.take(now, rl.factor)
+}
+
+// throttled slows down the outgoing messages after the server reported that
+// it dropped a message.
+func (rl *RateLimiter) throttled(now time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.factor > 0.125 {
+		rl.factor /= 2
+	}
+	rl.throttledUntil = now.Add(rl.ThrottleCooldown)
+	Warnf("The server dropped a message for being sent too quickly. Slowing down to %.0f%% of the configured rate.", rl.factor*100)
+}
+
+// Returns the room an outgoing message is sent to, or an empty string if it
+// is not sent to a room.
+func outgoingRoom(msg string) string {
+	i := strings.Index(msg, "|")
+	if i < 0 {
+		return ""
+	}
+	return msg[:i]
+}
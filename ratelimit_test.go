@@ -0,0 +1,55 @@
+package sdbot
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTokenBucketBurst tests that a bucket allows a burst of messages at once
+// and then refills at its rate.
+func TestTokenBucketBurst(t *testing.T) {
+	tb := NewTokenBucket(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := tb.take(now, 1); !ok {
+			t.Fatalf(`message %d of the burst should be allowed`, i+1)
+		}
+	}
+
+	ok, wait := tb.take(now, 1)
+	if ok {
+		t.Fatal(`message after the burst should not be allowed`)
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf(`wait (%v) should == 500ms`, wait)
+	}
+
+	if ok, _ := tb.take(now.Add(500*time.Millisecond), 1); !ok {
+		t.Error(`message after waiting should be allowed`)
+	}
+}
+
+// TestRateLimiterThrottled tests that the rate is halved after the server
+// reports a dropped message, and restored after the cooldown.
+func TestRateLimiterThrottled(t *testing.T) {
+	rl := &RateLimiter{
+		Room:             NewTokenBucket(1, 1),
+		Private:          NewTokenBucket(1, 1),
+		ThrottleCooldown: time.Minute,
+		factor:           1,
+	}
+	now := time.Now()
+
+	rl.take("room", now)
+	rl.throttled(now)
+	if _, wait := rl.take("room", now); wait != 2*time.Second {
+		t.Errorf(`wait (%v) should == 2s`, wait)
+	}
+
+	later := now.Add(2 * time.Minute)
+	rl.take("room", later)
+	if _, wait := rl.take("room", later); wait != time.Second {
+		t.Errorf(`wait (%v) should == 1s`, wait)
+	}
+}
@@ -0,0 +1,95 @@
+package sdbot
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrMaxReconnectAttempts is returned when the connection could not be
+// restored within the number of attempts allowed by the Config.
+var ErrMaxReconnectAttempts = errors.New("sdbot: maximum number of reconnect attempts reached")
+
+// Backoff computes the delays between reconnect attempts. Every attempt
+// multiplies the delay by Multiplier up to Max, and a random jitter of up to
+// Jitter (a fraction of the delay) is added or subtracted so that several bots
+// disconnected at the same time do not all hammer the server at once.
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxAttempts int
+	attempts    int
+}
+
+// NewBackoff creates a Backoff from the reconnect policy in the Config.
+func NewBackoff(c *Config) *Backoff {
+	return &Backoff{
+		Initial:     time.Duration(c.ReconnectDelay * float64(time.Second)),
+		Max:         time.Duration(c.ReconnectMaxDelay * float64(time.Second)),
+		Multiplier:  c.ReconnectMultiplier,
+		Jitter:      c.ReconnectJitter,
+		MaxAttempts: c.ReconnectMaxAttempts,
+	}
+}
+
+// Next returns the delay to wait before the next attempt. The boolean is false
+// once MaxAttempts attempts have been made. A MaxAttempts of zero retries
+// forever, and a negative MaxAttempts never retries.
+func (bo *Backoff) Next() (time.Duration, bool) {
+	if bo.MaxAttempts < 0 || (bo.MaxAttempts > 0 && bo.attempts >= bo.MaxAttempts) {
+		return 0, false
+	}
+
+	delay := float64(bo.Initial)
+	for i := 0; i < bo.attempts; i++ {
+		delay *= bo.Multiplier
+		if bo.Max > 0 && delay > float64(bo.Max) {
+			delay = float64(bo.Max)
+			break
+		}
+	}
+	if bo.Jitter > 0 {
+		delay += delay * bo.Jitter * (2*rand.Float64() - 1)
+	}
+
+	bo.attempts++
+	return time.Duration(delay), true
+}
+
+// Attempts returns the number of attempts made since the last Reset.
+func (bo *Backoff) Attempts() int {
+	return bo.attempts
+}
+
+// Reset resets the Backoff after a successful connection.
+func (bo *Backoff) Reset() {
+	bo.attempts = 0
+}
+
+// restoreSession brings the bot back to the state it was in before the
+// connection dropped: every room it had joined is joined again and the timed
+// plugins are resumed.
+func (b *Bot) restoreSession(attempts int) {
+	var rooms []string
+	var copyRooms = func() interface{} {
+		rooms = append(rooms, b.Rooms...)
+		return nil
+	}
+	b.Synchronize("room", &copyRooms)
+
+	for _, r := range b.Config.Rooms {
+		if !includes(rooms, r) {
+			rooms = append(rooms, r)
+		}
+	}
+
+	for _, r := range rooms {
+		b.JoinRoom(FindRoomEnsured(r, b))
+	}
+
+	b.StartTimedPlugins()
+	Infof("Session restored after %d reconnect attempt(s).", attempts)
+	b.reconnected(attempts)
+}
@@ -0,0 +1,289 @@
+package sdbot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBackoffGrowsAndCaps tests that the reconnect delays grow by the
+// multiplier, are capped at the maximum delay and stop once the maximum
+// number of attempts has been made.
+func TestBackoffGrowsAndCaps(t *testing.T) {
+	bo := &Backoff{
+		Initial:     time.Second,
+		Max:         5 * time.Second,
+		Multiplier:  2,
+		MaxAttempts: 5,
+	}
+
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}
+	for i, e := range expected {
+		d, ok := bo.Next()
+		if !ok {
+			t.Fatalf(`attempt %d should be allowed`, i+1)
+		}
+		if d != e {
+			t.Errorf(`delay %d (%v) should == %v`, i+1, d, e)
+		}
+	}
+
+	if _, ok := bo.Next(); ok {
+		t.Error(`attempt 6 should not be allowed`)
+	}
+
+	bo.Reset()
+	if d, _ := bo.Next(); d != time.Second {
+		t.Errorf(`delay after Reset (%v) should == 1s`, d)
+	}
+}
+
+// TestBackoffJitter tests that jittered delays stay within the jitter bounds.
+func TestBackoffJitter(t *testing.T) {
+	bo := &Backoff{Initial: time.Second, Multiplier: 1, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		d, ok := bo.Next()
+		if !ok {
+			t.Fatal(`unlimited backoff should always allow another attempt`)
+		}
+		if d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Errorf(`jittered delay (%v) should be within 0.5s and 1.5s`, d)
+		}
+	}
+}
+
+// TestBackoffDisabled tests that a negative MaxAttempts never reconnects.
+func TestBackoffDisabled(t *testing.T) {
+	bo := &Backoff{Initial: time.Second, MaxAttempts: -1}
+	if _, ok := bo.Next(); ok {
+		t.Error(`negative MaxAttempts should not allow any attempt`)
+	}
+}
+
+// fakeTransport is a Transport for the tests of the connection. Every dial
+// takes the next error of dials, and succeeds once there are none left. A
+// successful dial opens a connection that sends the frames of greeting, and
+// lasts until drop is called or a close frame is written, unless ignoreClose
+// is set.
+type fakeTransport struct {
+	mutex       sync.Mutex
+	ignoreClose bool
+	dials       []error
+	greeting    []string
+	conn        *fakeConn
+	writes      []string
+	closeFrames int
+	written     chan string
+}
+
+type fakeConn struct {
+	frames chan string
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func newFakeTransport(greeting ...string) *fakeTransport {
+	return &fakeTransport{greeting: greeting, written: make(chan string, 256)}
+}
+
+func (ft *fakeTransport) Dial(ctx context.Context, config *Config) error {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if len(ft.dials) > 0 {
+		err := ft.dials[0]
+		ft.dials = ft.dials[1:]
+		if err != nil {
+			return err
+		}
+	}
+	ft.conn = &fakeConn{frames: make(chan string, 64), done: make(chan struct{})}
+	for _, frame := range ft.greeting {
+		ft.conn.frames <- frame
+	}
+	return nil
+}
+
+func (ft *fakeTransport) current() *fakeConn {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return ft.conn
+}
+
+func (ft *fakeTransport) Read() ([]string, error) {
+	conn := ft.current()
+	select {
+	case frame := <-conn.frames:
+		return []string{frame}, nil
+	case <-conn.done:
+		return nil, conn.err
+	}
+}
+
+func (ft *fakeTransport) Write(frame string) error {
+	ft.mutex.Lock()
+	ft.writes = append(ft.writes, frame)
+	ft.mutex.Unlock()
+	ft.written <- frame
+	return nil
+}
+
+func (ft *fakeTransport) WriteClose() error {
+	ft.mutex.Lock()
+	ft.closeFrames++
+	ignore := ft.ignoreClose
+	ft.mutex.Unlock()
+	if !ignore {
+		ft.drop(errors.New("closed by the server"))
+	}
+	return nil
+}
+
+func (ft *fakeTransport) Close() error {
+	ft.drop(errors.New("closed"))
+	return nil
+}
+
+// Drops the current connection with the error, and makes the next dials fail
+// with the errors.
+func (ft *fakeTransport) drop(err error, dials ...error) {
+	ft.mutex.Lock()
+	conn := ft.conn
+	ft.dials = append(ft.dials, dials...)
+	ft.mutex.Unlock()
+
+	if conn != nil {
+		conn.once.Do(func() {
+			conn.err = err
+			close(conn.done)
+		})
+	}
+}
+
+// Waits for the bot to write a frame starting with prefix.
+func (ft *fakeTransport) waitFor(t *testing.T, prefix string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame := <-ft.written:
+			if strings.HasPrefix(frame, prefix) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf(`the bot should have written %q`, prefix)
+		}
+	}
+}
+
+// stubLoginClient hands out assertions without a login server.
+type stubLoginClient struct{}
+
+func (stubLoginClient) Assertion(nick, password, challengeKeyID, challenge string) (string, error) {
+	return "assertion", nil
+}
+
+// Creates a bot that connects with a fakeTransport, which logs it in as soon
+// as it connects.
+func initFakeBot() (*Bot, *fakeTransport) {
+	b := initBot()
+	b.Config.Nick = "Bot"
+	b.Config.ReconnectDelay = 0.001
+	b.Config.ReconnectMaxDelay = 0.001
+	b.Config.ReconnectMaxAttempts = 3
+	b.Config.MessagesPerSecond, b.Config.PrivateMessagesPerSecond = 100, 100
+	b.LoginClient = stubLoginClient{}
+	b.Connection = NewConnection(b)
+	ft := newFakeTransport("|challstr|4|abc", "|updateuser| Bot|1|1|{}")
+	b.Connection.Transport = ft
+	return b, ft
+}
+
+// TestReconnect tests that the bot reconnects after its connection drops,
+// calls the OnDisconnect hooks once per drop and the OnReconnect hooks once
+// per restored session, joins its rooms and restarts its timed plugins again,
+// and gives up after the maximum number of attempts.
+func TestReconnect(t *testing.T) {
+	b, ft := initFakeBot()
+
+	var hookMutex sync.Mutex
+	var disconnects int
+	reconnects := make(chan int, 4)
+	b.OnDisconnect(func(err error) {
+		hookMutex.Lock()
+		disconnects++
+		hookMutex.Unlock()
+	})
+	b.OnReconnect(func(attempts int) { reconnects <- attempts })
+
+	ticks := make(chan struct{}, 1024)
+	tp := NewTimedPlugin(5 * time.Millisecond)
+	tp.TimedEventHandler = timedFunc(func() { ticks <- struct{}{} })
+	if err := b.RegisterTimedPlugin(tp, "tick"); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- b.Run(context.Background()) }()
+	ft.waitFor(t, "|/join techcode")
+	waitTick(t, ticks)
+
+	ft.drop(errors.New("dropped"), errors.New("refused"), errors.New("refused"))
+	ft.waitFor(t, "|/join techcode")
+	select {
+	case attempts := <-reconnects:
+		if attempts != 3 {
+			t.Errorf(`attempts (%d) should == 3`, attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`the OnReconnect hooks should have been called`)
+	}
+	for len(ticks) > 0 {
+		<-ticks
+	}
+	waitTick(t, ticks)
+
+	ft.drop(errors.New("dropped"), errors.New("refused"), errors.New("refused"), errors.New("refused"), errors.New("refused"))
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrMaxReconnectAttempts) {
+			t.Errorf(`err (%v) should be ErrMaxReconnectAttempts`, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Run should have given up reconnecting`)
+	}
+
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	if disconnects != 2 {
+		t.Errorf(`disconnects (%d) should == 2`, disconnects)
+	}
+	if len(reconnects) != 0 {
+		t.Errorf(`the OnReconnect hooks were called %d more times, should be once`, len(reconnects))
+	}
+}
+
+// timedFunc is a TimedEventHandler calling a function.
+type timedFunc func()
+
+func (f timedFunc) HandleEvent() { f() }
+
+func waitTick(t *testing.T, ticks <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ticks:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`the timed plugin should be running`)
+	}
+}
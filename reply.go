@@ -0,0 +1,210 @@
+package sdbot
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// The ways to send replies that span multiple lines, as set by the
+// MultilineReplies field of the Config. With MultilineSplit every line is
+// sent as its own message. With MultilineCode the reply is sent to rooms as a
+// single !code block, and with MultilineHTMLBox as a single /addhtmlbox, which
+// needs the bot to have a rank in the room. Private replies are always split.
+const (
+	MultilineSplit   = "split"
+	MultilineCode    = "code"
+	MultilineHTMLBox = "htmlbox"
+)
+
+// The longest !code or /addhtmlbox message that is sent before a reply is
+// pasted or truncated instead.
+const maxBlockLength = 8192
+
+// The ellipsis that ends a truncated reply.
+const ellipsis = "…"
+
+// Paster uploads text that is too long to send in chat and returns a URL to
+// it. Set Bot.Paster to let the bot paste replies that would take more than
+// MaxReplyChunks messages.
+type Paster interface {
+	Paste(text string) (string, error)
+}
+
+// HastebinPaster pastes to Hastebin with the Haste helper.
+type HastebinPaster struct{}
+
+// Paste uploads the text to Hastebin.
+func (hp HastebinPaster) Paste(text string) (string, error) {
+	return Haste(strings.NewReader(text), "text/plain")
+}
+
+// Splits a reply into the messages to send, each starting with the prefix.
+// Long lines are split at word boundaries, or at rune boundaries for words
+// that do not fit in a message. If the reply takes more than MaxReplyChunks
+// messages it is pasted, if the bot has a Paster, and truncated otherwise.
+// When guard is set, every message is escaped with Escape, unless there is a
+// prefix for it to follow.
+func (b *Bot) formatReply(prefix string, res string, private bool, guard bool) []string {
+	res = strings.TrimRight(strings.Replace(res, "\r\n", "\n", -1), "\n")
+
+	if prefix != "" {
+		guard = false
+	}
+
+	width := b.Config.MaxMessageLength - len(prefix)
+	if guard {
+		res = strings.Replace(res, "|", "¦", -1)
+		width -= len(zeroWidthSpace)
+	}
+
+	if strings.Contains(res, "\n") && !private {
+		if block, ok := formatBlock(b.Config.MultilineReplies, prefix, res); ok {
+			return []string{block}
+		}
+		if b.Config.MultilineReplies != MultilineSplit {
+			return b.pasteOrTruncate(prefix, res, splitReply(res, width, guard))
+		}
+	}
+
+	chunks := splitReply(res, width, guard)
+	if len(chunks) > b.Config.MaxReplyChunks {
+		return b.pasteOrTruncate(prefix, res, chunks)
+	}
+	return prefixAll(prefix, chunks)
+}
+
+// Splits a reply into escaped messages like formatReply, but keeps them all
+// however many there are. Used for replies the user asked to read in full,
+// such as the help of a command group.
+func (b *Bot) formatAll(res string) []string {
+	res = strings.TrimRight(strings.Replace(res, "\r\n", "\n", -1), "\n")
+	return splitReply(res, b.Config.MaxMessageLength-len(zeroWidthSpace), true)
+}
+
+// Splits a reply into chunks, escaping every chunk when guard is set. Chunks
+// are escaped after splitting, since splitting a line can leave a / or ! at
+// the start of a chunk.
+func splitReply(res string, width int, guard bool) []string {
+	chunks := splitLines(res, width)
+	if guard {
+		for i, c := range chunks {
+			chunks[i] = Escape(c)
+		}
+	}
+	return chunks
+}
+
+// Formats a multi-line reply as a single block, if the mode allows and it
+// fits.
+func formatBlock(mode string, prefix string, res string) (string, bool) {
+	var block string
+	switch mode {
+	case MultilineCode:
+		block = "!code " + res
+		if prefix != "" {
+			block = "!code " + strings.TrimSpace(prefix) + "\n" + res
+		}
+	case MultilineHTMLBox:
+		block = "/addhtmlbox <pre>" + html.EscapeString(prefix+res) + "</pre>"
+	default:
+		return "", false
+	}
+	return block, len(block) <= maxBlockLength
+}
+
+// Pastes a reply that is too long and returns a message linking to it. If it
+// cannot be pasted, returns the first MaxReplyChunks chunks with the last one
+// ending in an ellipsis.
+func (b *Bot) pasteOrTruncate(prefix string, res string, chunks []string) []string {
+	if b.Paster != nil {
+		url, err := b.Paster.Paste(res)
+		if err == nil {
+			return []string{prefix + url}
+		}
+		b.reportError(err)
+	}
+
+	max := b.Config.MaxReplyChunks
+	if max < 1 {
+		max = 1
+	}
+	if len(chunks) <= max {
+		return prefixAll(prefix, chunks)
+	}
+
+	chunks = chunks[:max]
+	width := b.Config.MaxMessageLength - len(prefix) - len(ellipsis)
+	last := chunks[max-1]
+	if len(last) > width {
+		last = truncateRunes(last, width)
+	}
+	chunks[max-1] = last + ellipsis
+	return prefixAll(prefix, chunks)
+}
+
+func prefixAll(prefix string, chunks []string) []string {
+	for i, c := range chunks {
+		chunks[i] = prefix + c
+	}
+	return chunks
+}
+
+// Splits every line of the text into chunks of at most width bytes.
+func splitLines(s string, width int) []string {
+	var chunks []string
+	for _, line := range strings.Split(s, "\n") {
+		chunks = append(chunks, splitText(line, width)...)
+	}
+	return chunks
+}
+
+// Splits a line into chunks of at most width bytes, breaking between words
+// where possible, and never in the middle of a rune. Words are separated by
+// single spaces, so that runs of whitespace within a chunk are kept as they
+// are; only the space a chunk is broken at is dropped.
+func splitText(s string, width int) []string {
+	if width < utf8.UTFMax {
+		width = utf8.UTFMax
+	}
+	if len(s) <= width {
+		return []string{s}
+	}
+
+	var chunks []string
+	var current string
+	var started bool
+	for _, word := range strings.Split(s, " ") {
+		switch {
+		case !started && len(word) <= width:
+			current, started = word, true
+		case started && len(current)+1+len(word) <= width:
+			current += " " + word
+		default:
+			if current != "" {
+				chunks = append(chunks, current)
+			}
+			for len(word) > width {
+				head := truncateRunes(word, width)
+				chunks = append(chunks, head)
+				word = word[len(head):]
+			}
+			current, started = word, true
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// Returns the longest prefix of s of at most n bytes that does not cut a rune.
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,146 @@
+package sdbot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+type stubPaster struct {
+	text string
+	err  error
+}
+
+func (sp *stubPaster) Paste(text string) (string, error) {
+	sp.text = text
+	return "https://paste/abc", sp.err
+}
+
+// TestSplitTextWords tests that long lines are split between words and that
+// no chunk is longer than the width.
+func TestSplitTextWords(t *testing.T) {
+	chunks := splitText("the quick brown fox jumps over the lazy dog", 10)
+	expected := []string{"the quick", "brown fox", "jumps over", "the lazy", "dog"}
+
+	if len(chunks) != len(expected) {
+		t.Fatalf(`len(chunks) (%d) should == %d`, len(chunks), len(expected))
+	}
+	for i, e := range expected {
+		if chunks[i] != e {
+			t.Errorf(`chunks[%d] (%s) should == %s`, i, chunks[i], e)
+		}
+	}
+}
+
+// TestSplitTextWhitespace tests that runs of spaces and tabs within a chunk
+// are kept.
+func TestSplitTextWhitespace(t *testing.T) {
+	chunks := splitText("a  b\t\tc   d eeeeeeee", 12)
+	expected := []string{"a  b\t\tc   d", "eeeeeeee"}
+
+	if len(chunks) != len(expected) {
+		t.Fatalf(`chunks (%q) should == %q`, chunks, expected)
+	}
+	for i, e := range expected {
+		if chunks[i] != e {
+			t.Errorf(`chunks[%d] (%q) should == %q`, i, chunks[i], e)
+		}
+	}
+}
+
+// TestSplitTextRunes tests that words longer than the width are split without
+// cutting a rune in half.
+func TestSplitTextRunes(t *testing.T) {
+	s := strings.Repeat("é", 10)
+	chunks := splitText(s, 5)
+
+	if strings.Join(chunks, "") != s {
+		t.Errorf(`chunks (%q) should join to %q`, chunks, s)
+	}
+	for _, c := range chunks {
+		if len(c) > 5 {
+			t.Errorf(`chunk (%q) should be at most 5 bytes`, c)
+		}
+		if !utf8.ValidString(c) {
+			t.Errorf(`chunk (%q) should be valid UTF-8`, c)
+		}
+	}
+}
+
+// TestFormatReplyTruncates tests that a reply taking more than MaxReplyChunks
+// messages is truncated when the bot cannot paste it.
+func TestFormatReplyTruncates(t *testing.T) {
+	b := initBot()
+	b.Config.MaxMessageLength = 20
+	b.Config.MaxReplyChunks = 2
+
+	msgs := b.formatReply("(u) ", strings.Repeat("word ", 20), false, false)
+	if len(msgs) != 2 {
+		t.Fatalf(`len(msgs) (%d) should == 2`, len(msgs))
+	}
+	for _, m := range msgs {
+		if !strings.HasPrefix(m, "(u) ") {
+			t.Errorf(`msg (%s) should start with the prefix`, m)
+		}
+		if len(m) > 20 {
+			t.Errorf(`msg (%s) should be at most 20 bytes`, m)
+		}
+	}
+	if !strings.HasSuffix(msgs[1], ellipsis) {
+		t.Errorf(`msgs[1] (%s) should end with an ellipsis`, msgs[1])
+	}
+}
+
+// TestFormatReplyPastes tests that a reply taking more than MaxReplyChunks
+// messages is pasted when the bot has a Paster, and truncated if pasting
+// fails.
+func TestFormatReplyPastes(t *testing.T) {
+	b := initBot()
+	b.Config.MaxMessageLength = 20
+	b.Config.MaxReplyChunks = 2
+	sp := &stubPaster{}
+	b.Paster = sp
+
+	res := strings.Repeat("word ", 20)
+	msgs := b.formatReply("(u) ", res, false, false)
+	if len(msgs) != 1 || msgs[0] != "(u) https://paste/abc" {
+		t.Errorf(`msgs (%q) should == ["(u) https://paste/abc"]`, msgs)
+	}
+	if sp.text != strings.TrimSpace(res) && sp.text != res {
+		t.Errorf(`pasted text (%q) should == the reply`, sp.text)
+	}
+
+	sp.err = errors.New("paste failed")
+	if msgs := b.formatReply("(u) ", res, false, false); len(msgs) != 2 {
+		t.Errorf(`len(msgs) (%d) should == 2`, len(msgs))
+	}
+}
+
+// TestFormatReplyMultiline tests the ways of sending a reply with several
+// lines to a room.
+func TestFormatReplyMultiline(t *testing.T) {
+	b := initBot()
+
+	msgs := b.formatReply("(u) ", "one\ntwo", false, false)
+	if len(msgs) != 2 || msgs[0] != "(u) one" || msgs[1] != "(u) two" {
+		t.Errorf(`msgs (%q) should == ["(u) one" "(u) two"]`, msgs)
+	}
+
+	b.Config.MultilineReplies = MultilineCode
+	msgs = b.formatReply("(u) ", "one\ntwo", false, false)
+	if len(msgs) != 1 || msgs[0] != "!code (u)\none\ntwo" {
+		t.Errorf(`msgs (%q) should == ["!code (u)\none\ntwo"]`, msgs)
+	}
+
+	msgs = b.formatReply("(u) ", "one\ntwo", true, false)
+	if len(msgs) != 2 {
+		t.Errorf(`private len(msgs) (%d) should == 2`, len(msgs))
+	}
+
+	b.Config.MultilineReplies = MultilineHTMLBox
+	msgs = b.formatReply("", "<b>\ntwo", false, false)
+	if len(msgs) != 1 || msgs[0] != "/addhtmlbox <pre>&lt;b&gt;\ntwo</pre>" {
+		t.Errorf(`msgs (%q) should == ["/addhtmlbox <pre>&lt;b&gt;\ntwo</pre>"]`, msgs)
+	}
+}
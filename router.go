@@ -0,0 +1,163 @@
+package sdbot
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// router finds the plugins a message is meant for. Plugins whose command is
+// made of plain words and that use the prefixes of the Config are indexed by
+// the first word of their command, so that finding them takes a map lookup
+// once the prefix has been cut from the message. The subcommands of a
+// CommandGroup share the key of their root command. Only the plugins whose
+// command or prefix is a regexp are matched against every message.
+type router struct {
+	mutex           sync.RWMutex
+	prefixes        []string
+	caseInsensitive bool
+	commands        map[string][]*Plugin
+	fallback        []*Plugin
+}
+
+func newRouter(config *Config) *router {
+	r := &router{
+		caseInsensitive: config.CaseInsensitive,
+		commands:        make(map[string][]*Plugin),
+	}
+	for _, prefix := range config.PluginPrefixes {
+		if config.CaseInsensitive {
+			prefix = strings.ToLower(prefix)
+		}
+		if !includes(r.prefixes, prefix) {
+			r.prefixes = append(r.prefixes, prefix)
+		}
+	}
+	if len(r.prefixes) == 0 {
+		r.prefixes = []string{""}
+	}
+	return r
+}
+
+// Returns the key a plugin is indexed by, or false if it has to be matched
+// against every message. configPrefix tells whether the plugin uses the
+// prefixes of the Config.
+func routeKey(p *Plugin, configPrefix bool) (string, bool) {
+	if !configPrefix || p.Command == "" {
+		return "", false
+	}
+	words := strings.Split(p.Command, " ")
+	for _, word := range words {
+		if word == "" || strings.ContainsRune(word, '\t') || regexp.QuoteMeta(word) != word {
+			return "", false
+		}
+	}
+	return strings.ToLower(words[0]), true
+}
+
+// Adds a plugin under its key, or to the plugins that are matched against
+// every message.
+func (r *router) add(p *Plugin, configPrefix bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if key, ok := routeKey(p, configPrefix); ok {
+		r.commands[key] = append(r.commands[key], p)
+		return
+	}
+	r.fallback = append(r.fallback, p)
+}
+
+func (r *router) remove(p *Plugin) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.fallback = removePlugin(r.fallback, p)
+	for key, plugins := range r.commands {
+		plugins = removePlugin(plugins, p)
+		if len(plugins) == 0 {
+			delete(r.commands, key)
+		} else {
+			r.commands[key] = plugins
+		}
+	}
+}
+
+func removePlugin(plugins []*Plugin, p *Plugin) []*Plugin {
+	for i, plugin := range plugins {
+		if plugin == p {
+			return append(plugins[:i:i], plugins[i+1:]...)
+		}
+	}
+	return plugins
+}
+
+// Returns the plugins that accept and match the message. The indexed plugins
+// come first, then the plugins that are matched against every message, each
+// in the order they were registered. The root command of a CommandGroup is
+// left out when a subcommand or nested group matches too, so that only the
+// most specific command of the group gets the message.
+func (r *router) route(m *Message) []*Plugin {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var matched []*Plugin
+	for _, p := range r.candidates(m.Message) {
+		if p.accepts(m) && p.match(m) {
+			matched = append(matched, p)
+		}
+	}
+	matched = mostSpecific(matched)
+	for _, p := range r.fallback {
+		if p.accepts(m) && p.match(m) {
+			matched = append(matched, p)
+		}
+	}
+	return matched
+}
+
+// Returns the indexed plugins whose command follows one of the prefixes at the
+// start of the message. The command ends at the first space, where the
+// arguments start.
+func (r *router) candidates(msg string) []*Plugin {
+	text := msg
+	if r.caseInsensitive {
+		text = strings.ToLower(msg)
+	}
+
+	var candidates []*Plugin
+	for _, prefix := range r.prefixes {
+		if !strings.HasPrefix(text, prefix) {
+			continue
+		}
+		word := text[len(prefix):]
+		if i := strings.IndexByte(word, ' '); i >= 0 {
+			word = word[:i]
+		}
+		candidates = append(candidates, r.commands[strings.ToLower(word)]...)
+	}
+	return candidates
+}
+
+// Removes the root commands of groups from the plugins when a longer command
+// of the same group is among them.
+func mostSpecific(plugins []*Plugin) []*Plugin {
+	specific := plugins[:0:0]
+	for _, p := range plugins {
+		if p.group == nil || !hasSubcommand(plugins, p) {
+			specific = append(specific, p)
+		}
+	}
+	return specific
+}
+
+// Returns true if one of the plugins has a command under the root command.
+func hasSubcommand(plugins []*Plugin, root *Plugin) bool {
+	prefix := strings.ToLower(root.Command) + " "
+	for _, p := range plugins {
+		if strings.HasPrefix(strings.ToLower(p.Command), prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package sdbot
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestRoute tests that messages are routed to the plugins they match, whether
+// the plugins are indexed by their command or matched by their regexps.
+func TestRoute(t *testing.T) {
+	b := initBot()
+	hi := NewPlugin("hi")
+	say := NewPluginWithArgs("s(ay|peak)", 1)
+	echo := NewPluginWithArgs("echo", 1)
+	bang := NewPlugin("hi")
+	if err := bang.SetPrefix([]string{"!"}); err != nil {
+		t.Fatal(err)
+	}
+
+	plugins := map[string]*Plugin{"hi": hi, "say": say, "echo": echo, "bang": bang}
+	for name, p := range plugins {
+		if err := b.RegisterPlugin(p, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(b.router.commands) != 2 || len(b.router.fallback) != 2 {
+		t.Errorf(`the router should index 2 plugins and fall back for 2, not %d and %d`, len(b.router.commands), len(b.router.fallback))
+	}
+
+	tests := map[string]*Plugin{
+		".hi":       hi,
+		".HI":       hi,
+		".say hey":  say,
+		".speak up": say,
+		".echo foo": echo,
+		"!hi":       bang,
+		".hit":      nil,
+		".hi there": nil,
+		"hi":        nil,
+	}
+	for msg, expected := range tests {
+		m := NewMessage(">testroom\n|c:|1|+Mystifi|"+msg, b)
+		matched := b.router.route(m)
+		switch {
+		case expected == nil && len(matched) != 0:
+			t.Errorf(`%q should not match, but matched %s`, msg, matched[0].Name)
+		case expected != nil && (len(matched) != 1 || matched[0] != expected):
+			t.Errorf(`%q should match %s, but matched %d plugins`, msg, expected.Name, len(matched))
+		}
+	}
+
+	b.UnregisterPlugin(hi)
+	if matched := b.router.route(NewMessage(">testroom\n|c:|1|+Mystifi|.hi", b)); len(matched) != 0 {
+		t.Errorf(`an unregistered plugin should not be routed to`)
+	}
+}
+
+// Registers n plugins with plain commands, or with regexp commands that the
+// router has to match one by one.
+func benchmarkBot(b *testing.B, n int, regexps bool) *Bot {
+	bot := initBot()
+	for i := 0; i < n; i++ {
+		cmd := fmt.Sprintf("cmd%d", i)
+		if regexps {
+			cmd = fmt.Sprintf("c(md%d)", i)
+		}
+		if err := bot.RegisterPlugin(NewPluginWithArgs(cmd, 1), cmd); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Cleanup(func() {
+		for _, p := range append([]*Plugin{}, bot.Plugins...) {
+			bot.UnregisterPlugin(p)
+		}
+	})
+	return bot
+}
+
+// BenchmarkRoute200Plugins routes a command and a plain chat message with 200
+// plugins indexed by their commands.
+func BenchmarkRoute200Plugins(b *testing.B) {
+	bot := benchmarkBot(b, 200, false)
+	command := NewMessage(">testroom\n|c:|1|+Mystifi|.cmd150 some args", bot)
+	chat := NewMessage(">testroom\n|c:|1|+Mystifi|just chatting", bot)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bot.router.route(command)
+		bot.router.route(chat)
+	}
+}
+
+// BenchmarkRoute200RegexpPlugins routes the same messages with 200 plugins
+// whose commands are regexps, which are matched one by one like every plugin
+// used to be.
+func BenchmarkRoute200RegexpPlugins(b *testing.B) {
+	bot := benchmarkBot(b, 200, true)
+	command := NewMessage(">testroom\n|c:|1|+Mystifi|.cmd150 some args", bot)
+	chat := NewMessage(">testroom\n|c:|1|+Mystifi|just chatting", bot)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bot.router.route(command)
+		bot.router.route(chat)
+	}
+}
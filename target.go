@@ -1,7 +1,10 @@
 ﻿package sdbot
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 )
 
 // String values of all the auth levels.
@@ -34,15 +37,19 @@ var authLevels = map[string]int{
 }
 
 // User represents a user with their username and the auth levels in rooms
-// that the bot knows about.
+// that the bot knows about. GlobalAuth is their global rank, as last seen in
+// a private message.
 type User struct {
-	Name  string
-	Auths map[string]string
+	Name       string
+	Auths      map[string]string
+	GlobalAuth string
 }
 
-// Room represents a room with its name and the users currently in it.
+// Room represents a room with its name, its title and the users currently in
+// it.
 type Room struct {
 	Name  string
+	Title string
 	Users []string // List of unique SANITIZED names of users in the room
 }
 
@@ -55,40 +62,120 @@ func NewUser(name string) *User {
 }
 
 // Reply responds to a user in private message and prepends the user's name to
-// the response.
+// the response. Long responses are split into several messages.
 func (u *User) Reply(m *Message, res string) {
-	s := fmt.Sprintf("(%s) %s", m.User.Name, res)
-	if len(s) > 300 {
-		s = s[:300]
+	for _, s := range m.Bot.formatReply(fmt.Sprintf("(%s) ", m.User.Name), res, true, true) {
+		m.Bot.Connection.QueueMessage(fmt.Sprintf("|/w %s,%s", u.Name, s))
 	}
-	m.Bot.Connection.QueueMessage(fmt.Sprintf("|/w %s,%s", u.Name, s))
 }
 
 // Reply responds to a user in a chat message and prepends the user's name to
 // the response. The message is sent to the Room of the method's receiver.
+// Long responses are split into several messages. Nothing is prepended to
+// replies to HTML messages, which have no user.
 func (r *Room) Reply(m *Message, res string) {
-	s := fmt.Sprintf("(%s) %s", m.User.Name, res)
-	if len(s) > 300 {
-		s = s[:300]
+	var prefix string
+	if m.User != nil {
+		prefix = fmt.Sprintf("(%s) ", m.User.Name)
+	}
+	for _, s := range m.Bot.formatReply(prefix, res, false, true) {
+		m.Bot.Connection.QueueMessage(fmt.Sprintf("%s|%s", r.Name, s))
 	}
-	m.Bot.Connection.QueueMessage(fmt.Sprintf("%s|%s", r.Name, s))
 }
 
 // RawReply responds to a user in private message without prepending their
-// username.
+// username. The response is escaped with Escape unless the Config sets
+// AllowRawCommands.
 func (u *User) RawReply(m *Message, res string) {
-	if len(res) > 300 {
-		res = res[:300]
+	for _, s := range m.Bot.formatReply("", res, true, !m.Bot.Config.AllowRawCommands) {
+		m.Bot.Connection.QueueMessage(fmt.Sprintf("|/w %s,%s", u.Name, s))
+	}
+}
+
+// Sends a reply to the user in private message, one message per line and
+// without the MaxReplyChunks cap.
+func (u *User) replyAll(m *Message, res string) {
+	for _, s := range m.Bot.formatAll(res) {
+		m.Bot.Connection.QueueMessage(fmt.Sprintf("|/w %s,%s", u.Name, s))
 	}
-	m.Bot.Connection.QueueMessage(fmt.Sprintf("|/w %s,%s", u.Name, res))
 }
 
 // RawReply responds to a user in a room without prepending their username.
+// The response is escaped with Escape unless the Config sets
+// AllowRawCommands.
 func (r *Room) RawReply(m *Message, res string) {
-	if len(res) > 300 {
-		res = res[:300]
+	for _, s := range m.Bot.formatReply("", res, false, !m.Bot.Config.AllowRawCommands) {
+		m.Bot.Connection.QueueMessage(fmt.Sprintf("%s|%s", r.Name, s))
+	}
+}
+
+// Command runs a server command in private message with the user, such as
+// /invite. See Bot.Command for the name and arguments.
+func (u *User) Command(m *Message, name string, args ...string) error {
+	cmd, err := formatCommand(name, args...)
+	if err != nil {
+		return err
+	}
+	m.Bot.Connection.QueueMessage(fmt.Sprintf("|/w %s,%s", u.Name, cmd))
+	return nil
+}
+
+// Command runs a server command in the room. See Bot.Command for the name and
+// arguments.
+func (r *Room) Command(m *Message, name string, args ...string) error {
+	_, err := m.Bot.Command(r.Name, name, args...)
+	return err
+}
+
+// ErrInvalidCommand is returned by Command when the name of the command is not
+// a single word.
+var ErrInvalidCommand = errors.New("sdbot: invalid command name")
+
+var commandNameRegexp = regexp.MustCompile(`^[/!]?[A-Za-z0-9]+$`)
+
+// Prepended to text starting with ! so that the server shows it instead of
+// running it as a command.
+const zeroWidthSpace = "\u200b"
+
+// Replaces the characters that would let text start another command or
+// protocol message.
+var lineReplacer = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "|", "¦")
+
+// Escape makes text safe to send as chat, so that a plugin repeating what a
+// user said cannot be made to run commands with the bot's rank. Text starting
+// with / is escaped with another /, text starting with ! is escaped with a
+// zero width space, and newlines and | separators are replaced.
+func Escape(s string) string {
+	s = lineReplacer.Replace(s)
+	trimmed := strings.TrimLeft(s, " \t")
+	switch {
+	case strings.HasPrefix(trimmed, "/"):
+		return "/" + trimmed
+	case strings.HasPrefix(trimmed, "!"):
+		return zeroWidthSpace + trimmed
 	}
-	m.Bot.Connection.QueueMessage(fmt.Sprintf("%s|%s", r.Name, res))
+	return s
+}
+
+// Builds the text of a command. The name may start with / or !, and is run
+// with / if it starts with neither. The arguments have their newlines and |
+// separators replaced, and are joined with commas.
+func formatCommand(name string, args ...string) (string, error) {
+	if !commandNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidCommand, name)
+	}
+	if name[0] != '/' && name[0] != '!' {
+		name = "/" + name
+	}
+	if len(args) == 0 {
+		return name, nil
+	}
+
+	escaped := make([]string, len(args))
+	for i, arg := range args {
+		escaped[i] = strings.TrimSpace(lineReplacer.Replace(arg))
+	}
+	return name + " " + strings.Join(escaped, ", "), nil
 }
 
 // AddAuth adds a room authority level to a user.
@@ -173,8 +260,17 @@ func Rename(old string, s string, r *Room, b *Bot, auth string) {
 }
 
 // HasAuth checks if a user has AT LEAST a given authorization level in a given room.
+// Levels that are not ranks, such as BotOwner, are never met; use Bot.IsOwner
+// to check for the owners of the bot.
 func (u *User) HasAuth(roomname string, level string) bool {
-	return authLevels[u.Auths[roomname]] >= authLevels[level]
+	return hasLevel(u.Auths[Sanitize(roomname)], level)
+}
+
+// HasGlobalAuth checks if a user has AT LEAST a given global authorization
+// level. The global rank is only known once the user has sent the bot a
+// private message. Like HasAuth, it is false for BotOwner.
+func (u *User) HasGlobalAuth(level string) bool {
+	return hasLevel(u.GlobalAuth, level)
 }
 
 // Target represents either a Room or a User. The distinction is in where the bot will
@@ -182,4 +278,5 @@ func (u *User) HasAuth(roomname string, level string) bool {
 type Target interface {
 	Reply(*Message, string)
 	RawReply(*Message, string)
+	Command(*Message, string, ...string) error
 }
@@ -1,6 +1,8 @@
 package sdbot
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -11,7 +13,7 @@ import (
 func TestRenameDifferentName(t *testing.T) {
 	b := initBot()
 	joinMsg := ">testroom\n|J|+Tympy"
-	b.Connection.parse(joinMsg)
+	b.Connection.parse(joinMsg, false)
 
 	u := b.UserList["tympy"]
 	r := b.RoomList["testroom"]
@@ -37,7 +39,7 @@ func TestRenameDifferentName(t *testing.T) {
 	}
 
 	renameMsg := ">testroom\n|N|+Tympani|tympy"
-	b.Connection.parse(renameMsg)
+	b.Connection.parse(renameMsg, false)
 
 	newu := b.UserList["tympani"]
 	newr := b.RoomList["testroom"]
@@ -69,7 +71,7 @@ func TestRenameDifferentName(t *testing.T) {
 func TestRenameSameNames(t *testing.T) {
 	b := initBot()
 	joinMsg := ">testroom\n|J|+Tympy"
-	b.Connection.parse(joinMsg)
+	b.Connection.parse(joinMsg, false)
 
 	u := b.UserList["tympy"]
 	r := b.RoomList["testroom"]
@@ -95,7 +97,7 @@ func TestRenameSameNames(t *testing.T) {
 	}
 
 	renameMsg := ">testroom\n|N|+T#ympy|tympy"
-	b.Connection.parse(renameMsg)
+	b.Connection.parse(renameMsg, false)
 
 	newu := b.UserList["tympy"]
 	newr := b.RoomList["testroom"]
@@ -122,5 +124,77 @@ func TestRenameSameNames(t *testing.T) {
 }
 
 func initBot() *Bot {
-	return NewBot("examples/config/config_example.toml")
+	b, err := NewBot("examples/config/config_example.toml")
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// TestEscape tests that escaped text cannot run a command or start another
+// protocol message.
+func TestEscape(t *testing.T) {
+	tests := map[string]string{
+		"hello":           "hello",
+		"/roomban x":      "//roomban x",
+		"  /ban x":        "//ban x",
+		"!htmlbox <b>":    zeroWidthSpace + "!htmlbox <b>",
+		"hi\n/ban x":      "hi /ban x",
+		"a|/ban x":        "a¦/ban x",
+		"hi /me is great": "hi /me is great",
+	}
+	for in, out := range tests {
+		if e := Escape(in); e != out {
+			t.Errorf(`Escape(%q) (%q) should == %q`, in, e, out)
+		}
+	}
+}
+
+// TestRawReplyGuard tests that a raw reply is escaped after it is split, so
+// that no message starts with a command, unless raw commands are allowed.
+func TestRawReplyGuard(t *testing.T) {
+	b := initBot()
+	b.Config.MaxMessageLength = 20
+
+	for _, s := range b.formatReply("", "hello there\n/ban x\nfoo bar baz !htmlbox hi", false, true) {
+		if strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") || strings.HasPrefix(s, "!") {
+			t.Errorf(`message (%q) should not start with a command`, s)
+		}
+	}
+
+	msgs := b.formatReply("", "/ban x", false, false)
+	if len(msgs) != 1 || msgs[0] != "/ban x" {
+		t.Errorf(`msgs (%q) should == ["/ban x"]`, msgs)
+	}
+}
+
+// TestFormatCommand tests that commands are run with / by default, that their
+// arguments cannot start another command, and that invalid names are refused.
+func TestFormatCommand(t *testing.T) {
+	cmd, err := formatCommand("roomban", "Tympy", "spam\n/ban x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != "/roomban Tympy, spam /ban x" {
+		t.Errorf(`cmd (%q) should == "/roomban Tympy, spam /ban x"`, cmd)
+	}
+
+	cmd, err = formatCommand("!dt", "pikachu")
+	if err != nil || cmd != "!dt pikachu" {
+		t.Errorf(`cmd (%q) should == "!dt pikachu"`, cmd)
+	}
+
+	if _, err := formatCommand("ban x\n/lock"); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf(`err (%v) should be ErrInvalidCommand`, err)
+	}
+}
+
+// TestReplyPrefixNotEscaped tests that a reply with a prefix is sent as it is,
+// since no command can run after the prefix.
+func TestReplyPrefixNotEscaped(t *testing.T) {
+	b := initBot()
+	msgs := b.formatReply("(u) ", "/help x\n!dt pikachu", false, true)
+	if len(msgs) != 2 || msgs[0] != "(u) /help x" || msgs[1] != "(u) !dt pikachu" {
+		t.Errorf(`msgs (%q) should == ["(u) /help x" "(u) !dt pikachu"]`, msgs)
+	}
 }
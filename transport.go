@@ -0,0 +1,316 @@
+package sdbot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries frames between the bot and the server. A frame is what
+// the server sends in one go, such as a room name line followed by the lines
+// of that room. Whatever the transport, the frames are the same, so the rest
+// of the bot does not need to know how it is connected.
+//
+// Read and Write are called from different goroutines, but never
+// concurrently with themselves. Close may be called at any time, and Dial is
+// called again after Close to reconnect.
+type Transport interface {
+	// Dial connects to the server described by the Config.
+	Dial(ctx context.Context, config *Config) error
+	// Read blocks until the server sends something, and returns the frames
+	// it sent. It may return no frames for messages that only concern the
+	// transport, such as heartbeats.
+	Read() ([]string, error)
+	// Write sends a frame to the server.
+	Write(frame string) error
+	// WriteClose asks the server to close the connection.
+	WriteClose() error
+	// Close closes the connection without waiting for the server.
+	Close() error
+}
+
+// The transports that can be chosen with the Transport field of the Config.
+const (
+	TransportWebsocket = "websocket"
+	TransportSockJS    = "sockjs"
+)
+
+// ErrUnknownTransport is returned when the Config names a transport that does
+// not exist.
+var ErrUnknownTransport = errors.New("sdbot: unknown transport (use websocket or sockjs)")
+
+// Creates the transport named by the Config.
+func newTransport(config *Config) Transport {
+	if config.Transport == TransportSockJS {
+		return &SockJSTransport{}
+	}
+	return &WebsocketTransport{}
+}
+
+// WebsocketTransport connects to the raw websocket endpoint of the server,
+// where every websocket message is a frame.
+type WebsocketTransport struct {
+	conn *websocket.Conn
+}
+
+// Dial connects to Scheme://Server:Port/Path.
+func (t *WebsocketTransport) Dial(ctx context.Context, config *Config) error {
+	conn, err := dialWebsocket(ctx, config, websocketURL(config, config.Path))
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	return nil
+}
+
+// Read returns the next websocket message as a frame.
+func (t *WebsocketTransport) Read() ([]string, error) {
+	_, msg, err := t.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(msg)}, nil
+}
+
+// Write sends a frame as a websocket message.
+func (t *WebsocketTransport) Write(frame string) error {
+	return t.conn.WriteMessage(websocket.TextMessage, []byte(frame))
+}
+
+// WriteClose sends a websocket close frame.
+func (t *WebsocketTransport) WriteClose() error {
+	return writeCloseMessage(t.conn)
+}
+
+// Close closes the websocket.
+func (t *WebsocketTransport) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+// SockJSTransport connects to the websocket endpoint of the SockJS server
+// that fronts Pokemon Showdown, at Path/<server>/<session>/websocket. SockJS
+// wraps the frames: "o" opens the session, "h" is a heartbeat, "a" carries a
+// JSON array of frames and "c" closes the session with a code and a reason.
+// Frames sent to the server are wrapped in a JSON array.
+type SockJSTransport struct {
+	conn *websocket.Conn
+}
+
+// Dial connects to a new SockJS session.
+func (t *SockJSTransport) Dial(ctx context.Context, config *Config) error {
+	server := fmt.Sprintf("%03d", rand.Intn(1000))
+	session := randomSessionID(8)
+	u := websocketURL(config, path.Join(config.Path, server, session, "websocket"))
+
+	conn, err := dialWebsocket(ctx, config, u)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	return nil
+}
+
+// ErrSockJSFrame is returned when the server sends a SockJS frame that cannot
+// be decoded.
+var ErrSockJSFrame = errors.New("sdbot: malformed sockjs frame")
+
+// Read unwraps the next SockJS frame. A close frame is returned as a
+// *websocket.CloseError.
+func (t *SockJSTransport) Read() ([]string, error) {
+	_, msg, err := t.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return decodeSockJSFrame(msg)
+}
+
+// Write wraps a frame in a JSON array and sends it.
+func (t *SockJSTransport) Write(frame string) error {
+	data, err := json.Marshal([]string{frame})
+	if err != nil {
+		return err
+	}
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// WriteClose sends a websocket close frame.
+func (t *SockJSTransport) WriteClose() error {
+	return writeCloseMessage(t.conn)
+}
+
+// Close closes the websocket.
+func (t *SockJSTransport) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+func decodeSockJSFrame(msg []byte) ([]string, error) {
+	if len(msg) == 0 {
+		return nil, ErrSockJSFrame
+	}
+
+	switch msg[0] {
+	case 'o', 'h':
+		return nil, nil
+	case 'a':
+		var frames []string
+		if err := json.Unmarshal(msg[1:], &frames); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSockJSFrame, err)
+		}
+		return frames, nil
+	case 'm':
+		var frame string
+		if err := json.Unmarshal(msg[1:], &frame); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSockJSFrame, err)
+		}
+		return []string{frame}, nil
+	case 'c':
+		var reason []interface{}
+		if err := json.Unmarshal(msg[1:], &reason); err != nil || len(reason) < 2 {
+			return nil, ErrSockJSFrame
+		}
+		code, _ := reason[0].(float64)
+		text, _ := reason[1].(string)
+		return nil, &websocket.CloseError{Code: int(code), Text: text}
+	default:
+		return nil, ErrSockJSFrame
+	}
+}
+
+const sessionIDChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+func randomSessionID(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = sessionIDChars[rand.Intn(len(sessionIDChars))]
+	}
+	return string(b)
+}
+
+// Returns the URL of a websocket endpoint on the server.
+func websocketURL(config *Config, p string) *url.URL {
+	host := config.Server
+	if config.Port != "" {
+		host = net.JoinHostPort(host, config.Port)
+	}
+	return &url.URL{Scheme: config.Scheme, Host: host, Path: p}
+}
+
+// Dials a websocket with the dial options and handshake headers of the
+// Config. Older versions of the websocket package cannot dial with a context,
+// so the connection is dialed with it and closed if the context is done
+// before the handshake is over, and the handshake ends by its deadline.
+func dialWebsocket(ctx context.Context, config *Config, u *url.URL) (*websocket.Conn, error) {
+	dialer, err := newDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); dialer.HandshakeTimeout == 0 || left < dialer.HandshakeTimeout {
+			dialer.HandshakeTimeout = left
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}()
+		return conn, nil
+	}
+
+	Info("Connecting to " + u.String() + "...")
+	conn, res, err := dialer.Dial(u.String(), handshakeHeader(config))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	res.Body.Close()
+	return conn, nil
+}
+
+// Creates a websocket dialer with the TLS, proxy, timeout and compression
+// settings of the Config. The proxy may be an http, https or socks5 URL, or
+// "environment" to use the HTTP_PROXY and HTTPS_PROXY environment variables.
+func newDialer(config *Config) (*websocket.Dialer, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout:  time.Duration(config.HandshakeTimeout * float64(time.Second)),
+		EnableCompression: config.EnableCompression,
+	}
+
+	switch config.Proxy {
+	case "":
+	case "environment":
+		dialer.Proxy = http.ProxyFromEnvironment
+	default:
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("sdbot: invalid proxy URL: %w", err)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.Scheme == "wss" {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: config.TLSInsecureSkipVerify,
+		}
+		if config.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(config.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("sdbot: could not read CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("sdbot: no certificates found in CA file %s", config.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		dialer.TLSClientConfig = tlsConfig
+	}
+
+	return dialer, nil
+}
+
+// Returns the headers sent with the websocket handshake.
+func handshakeHeader(config *Config) http.Header {
+	h := http.Header{}
+	for k, v := range config.Headers {
+		h.Set(k, v)
+	}
+	if h.Get("Origin") == "" && config.Origin != "" {
+		h.Set("Origin", config.Origin)
+	}
+	return h
+}
+
+func writeCloseMessage(conn *websocket.Conn) error {
+	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
@@ -0,0 +1,241 @@
+package sdbot
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestSockJSTransport tests that the SockJS transport connects to a session
+// endpoint, unwraps the frames the server sends and wraps the frames it sends
+// to the server.
+func TestSockJSTransport(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	received := make(chan string, 1)
+	var path string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`o`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`h`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`a[">testroom\n|c|+Tympy|hi","|challstr|1|abc"]`))
+		_, msg, _ := conn.ReadMessage()
+		received <- string(msg)
+		conn.WriteMessage(websocket.TextMessage, []byte(`c[3000,"Go away!"]`))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	config := &Config{
+		Server:    u.Hostname(),
+		Port:      u.Port(),
+		Scheme:    "ws",
+		Path:      "/showdown",
+		Transport: TransportSockJS,
+	}
+
+	tr := newTransport(config)
+	if err := tr.Dial(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if !strings.HasPrefix(path, "/showdown/") || !strings.HasSuffix(path, "/websocket") || strings.Count(path, "/") != 4 {
+		t.Errorf(`path (%s) should == "/showdown/<server>/<session>/websocket"`, path)
+	}
+
+	var frames []string
+	for len(frames) == 0 {
+		f, err := tr.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = f
+	}
+	if len(frames) != 2 {
+		t.Fatalf(`len(frames) (%d) should == 2`, len(frames))
+	}
+	if frames[0] != ">testroom\n|c|+Tympy|hi" {
+		t.Errorf(`frames[0] (%q) should == ">testroom\n|c|+Tympy|hi"`, frames[0])
+	}
+	if frames[1] != "|challstr|1|abc" {
+		t.Errorf(`frames[1] (%q) should == "|challstr|1|abc"`, frames[1])
+	}
+
+	tr.Write("|/trn Bot,0,assertion")
+	if msg := <-received; msg != `["|/trn Bot,0,assertion"]` {
+		t.Errorf(`msg (%s) should == ["|/trn Bot,0,assertion"]`, msg)
+	}
+
+	_, err := tr.Read()
+	if !websocket.IsCloseError(err, 3000) {
+		t.Errorf(`err (%v) should be a close error with code 3000`, err)
+	}
+}
+
+// TestWebsocketURL tests that the websocket URL is built from the scheme,
+// server, port and path of the Config.
+func TestWebsocketURL(t *testing.T) {
+	tests := []struct {
+		config   *Config
+		expected string
+	}{
+		{&Config{Scheme: "ws", Server: "sim.smogon.com", Port: "8000", Path: "/showdown/websocket"}, "ws://sim.smogon.com:8000/showdown/websocket"},
+		{&Config{Scheme: "wss", Server: "sim3.psim.us", Path: "/showdown/websocket"}, "wss://sim3.psim.us/showdown/websocket"},
+		{&Config{Scheme: "ws", Server: "::1", Port: "8000", Path: "/ws"}, "ws://[::1]:8000/ws"},
+	}
+	for i, test := range tests {
+		if u := websocketURL(test.config, test.config.Path).String(); u != test.expected {
+			t.Errorf(`websocketURL(tests[%d].config) (%s) should == %s`, i, u, test.expected)
+		}
+	}
+}
+
+// TestNewDialer tests that the dialer takes the proxy and handshake timeout
+// of the Config, and that invalid settings are refused.
+func TestNewDialer(t *testing.T) {
+	dialer, err := newDialer(&Config{Scheme: "ws", Proxy: "socks5://proxy:1080", HandshakeTimeout: 2.5, EnableCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.HandshakeTimeout != 2500*time.Millisecond {
+		t.Errorf(`dialer.HandshakeTimeout (%v) should == 2.5s`, dialer.HandshakeTimeout)
+	}
+	if !dialer.EnableCompression {
+		t.Error(`dialer.EnableCompression should be true`)
+	}
+	if dialer.TLSClientConfig != nil {
+		t.Error(`dialer.TLSClientConfig should be nil for ws`)
+	}
+	req, _ := http.NewRequest("GET", "http://sim.smogon.com:8000/showdown/websocket", nil)
+	if proxy, err := dialer.Proxy(req); err != nil || proxy.String() != "socks5://proxy:1080" {
+		t.Errorf(`dialer.Proxy (%v, %v) should == socks5://proxy:1080, nil`, proxy, err)
+	}
+
+	dialer, err = newDialer(&Config{Scheme: "wss", TLSInsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.TLSClientConfig == nil || !dialer.TLSClientConfig.InsecureSkipVerify {
+		t.Error(`dialer.TLSClientConfig.InsecureSkipVerify should be true`)
+	}
+
+	if _, err := newDialer(&Config{Scheme: "ws", Proxy: "://nope"}); err == nil {
+		t.Error(`an invalid proxy URL should be refused`)
+	}
+	if _, err := newDialer(&Config{Scheme: "wss", TLSCAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error(`a missing CA file should be refused`)
+	}
+}
+
+// TestDialWebsocketTLS tests that the handshake sends the headers and origin
+// of the Config, and that the server certificate is checked against the CA
+// file unless verification is turned off.
+func TestDialWebsocketTLS(t *testing.T) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	headers := make(chan http.Header, 3)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	config := &Config{
+		Server:  u.Hostname(),
+		Port:    u.Port(),
+		Scheme:  "wss",
+		Path:    "/showdown/websocket",
+		Origin:  "https://example.com",
+		Headers: map[string]string{"User-Agent": "sdbot-test"},
+	}
+
+	if _, err := dialWebsocket(context.Background(), config, websocketURL(config, config.Path)); err == nil {
+		t.Error(`dialing a server with an unknown certificate should fail`)
+	}
+
+	config.TLSCAFile = caFile
+	conn, err := dialWebsocket(context.Background(), config, websocketURL(config, config.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	h := <-headers
+	if h.Get("Origin") != "https://example.com" || h.Get("User-Agent") != "sdbot-test" {
+		t.Errorf(`the handshake headers (%v) should have the origin and headers of the config`, h)
+	}
+
+	config.TLSCAFile = ""
+	config.TLSInsecureSkipVerify = true
+	config.Headers["Origin"] = "https://override.example.com"
+	conn, err = dialWebsocket(context.Background(), config, websocketURL(config, config.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if h := <-headers; h.Get("Origin") != "https://override.example.com" {
+		t.Errorf(`Origin (%s) should == https://override.example.com`, h.Get("Origin"))
+	}
+}
+
+// TestDialWebsocketTimeout tests that the handshake gives up after the
+// HandshakeTimeout of the Config, and when the context is cancelled.
+func TestDialWebsocketTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	config := &Config{Server: host, Port: port, Scheme: "ws", Path: "/", HandshakeTimeout: 0.1}
+	start := time.Now()
+	if _, err := dialWebsocket(context.Background(), config, websocketURL(config, config.Path)); err == nil {
+		t.Error(`a handshake the server never answers should fail`)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf(`the handshake took %v, should time out after 100ms`, elapsed)
+	}
+
+	config.HandshakeTimeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := dialWebsocket(ctx, config, websocketURL(config, config.Path)); err != context.Canceled {
+		t.Errorf(`err (%v) should == context.Canceled`, err)
+	}
+}